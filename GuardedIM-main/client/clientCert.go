@@ -0,0 +1,102 @@
+package client
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// loadOrCreateClientKey returns the key of client.key in cert_dir, creating an ECDSA P-256
+// key there on first use. It stays on disk while an enrollment waits for approval, so the
+// certificate issued later matches it.
+func loadOrCreateClientKey(cert_dir string) (crypto.Signer, error) {
+	path := filepath.Join(cert_dir, "client.key")
+	keyPem, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(keyPem)
+		if block == nil {
+			return nil, fmt.Errorf("no key in %s", path)
+		}
+		return parsePrivateKey(block.Bytes)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(cert_dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// parsePrivateKey reads a PKCS #8, PKCS #1 or SEC 1 private key
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("unsupported private key")
+}
+
+// newClientCSR is the PEM certificate request /enroll signs into client.crt
+func newClientCSR(cert_dir string, username string) (string, error) {
+	key, err := loadOrCreateClientKey(cert_dir)
+	if err != nil {
+		return "", fmt.Errorf("client key: %w", err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: username},
+	}, key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})), nil
+}
+
+// storeClientCert writes the certificate from an enrollment to client.crt, after
+// making sure it belongs to client.key
+func storeClientCert(cert_dir string, certPem string) error {
+	block, _ := pem.Decode([]byte(certPem))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return errors.New("server sent no certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return err
+	}
+	key, err := loadOrCreateClientKey(cert_dir)
+	if err != nil {
+		return err
+	}
+	if pub, ok := cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(key.Public()) {
+		return errors.New("server sent a certificate for another key")
+	}
+	return os.WriteFile(filepath.Join(cert_dir, "client.crt"), []byte(certPem), 0644)
+}
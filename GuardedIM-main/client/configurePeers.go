@@ -0,0 +1,153 @@
+package client
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"guardedim/overlay"
+	"log"
+	"net"
+	"net/netip"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// ──────────── ConfigureServerPeers ─────────────────────────────────────
+// Makes the home relay (whose subnet holds clientIP) the only peer of ov.Interface.
+// • It carries the supernet and ULA prefix, the relays route everything else among themselves.
+// • Only the home relay has this client as a peer, the others would never answer.
+// • No preshared key: the relay table serves none, relays only use one among themselves.
+// The live device is compared first and only what differs is applied, so the
+// session survives the periodic call and peers left from other relays are removed.
+// Returns the number of relay peers configured, 0 when the table is empty.
+func ConfigureServerPeers(db *sql.DB, ov overlay.Config, clientIP string) (int, error) {
+	client_ip, err := netip.ParseAddr(clientIP)
+	if err != nil {
+		return 0, errors.New("invalid client IP")
+	}
+	keepalive_interval := 25 * time.Second
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT server_pubip, server_port, server_privip, server_subnet, server_pubkey
+		FROM server_info_table`)
+	if err != nil {
+		return 0, fmt.Errorf("read relays: %w", err)
+	}
+	defer rows.Close()
+
+	var home *wgtypes.PeerConfig
+	relays := 0
+	for rows.Next() {
+		var pub_ip, priv_ip, pubkey_bytes []byte
+		var subnet sql.NullString
+		var port int
+		if err := rows.Scan(&pub_ip, &port, &priv_ip, &subnet, &pubkey_bytes); err != nil {
+			log.Printf("scan relay row failed: %v", err)
+			continue
+		}
+		relays++
+		relay_ip := addrFromBlob(priv_ip)
+		// relay tables fetched before subnets were served fall back to the /24 around the relay
+		home_net, err := netip.ParsePrefix(subnet.String)
+		if err != nil {
+			home_net = netip.PrefixFrom(relay_ip, 24).Masked()
+		}
+		if !relay_ip.IsValid() || !home_net.Contains(client_ip) {
+			continue
+		}
+
+		pubkey, err := wgtypes.NewKey(pubkey_bytes)
+		if err != nil {
+			return 0, fmt.Errorf("home relay: invalid pubkey: %w", err)
+		}
+		endpoint_ip := addrFromBlob(pub_ip)
+		if !endpoint_ip.IsValid() {
+			return 0, errors.New("home relay: invalid IP bytes")
+		}
+		home = &wgtypes.PeerConfig{
+			PublicKey:                   pubkey,
+			Endpoint:                    net.UDPAddrFromAddrPort(netip.AddrPortFrom(endpoint_ip, uint16(port))),
+			AllowedIPs:                  overlay.IPNets(ov.Routes()...),
+			ReplaceAllowedIPs:           true,
+			PersistentKeepaliveInterval: &keepalive_interval,
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if relays == 0 {
+		return 0, nil
+	}
+	if home == nil {
+		return 0, fmt.Errorf("no relay in the local table serves %s", client_ip)
+	}
+
+	wg, err := wgctrl.New()
+	if err != nil {
+		return 0, err
+	}
+	defer wg.Close()
+
+	wg_dev, err := wg.Device(ov.Interface)
+	if err != nil {
+		return 0, err
+	}
+	var delta []wgtypes.PeerConfig
+	found := false
+	for _, p := range wg_dev.Peers {
+		if p.PublicKey != home.PublicKey {
+			delta = append(delta, wgtypes.PeerConfig{PublicKey: p.PublicKey, Remove: true})
+			continue
+		}
+		found = true
+		if relayPeerChanged(p, *home) {
+			update := *home
+			// a nil PresharedKey means "leave as is", clear a stale one explicitly
+			update.PresharedKey = &wgtypes.Key{}
+			update.UpdateOnly = true
+			delta = append(delta, update)
+		}
+	}
+	if !found {
+		delta = append(delta, *home)
+	}
+	if len(delta) == 0 {
+		return 1, nil
+	}
+	if err := wg.ConfigureDevice(ov.Interface, wgtypes.Config{Peers: delta}); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// relayPeerChanged tells whether the live peer differs from want in anything ConfigureServerPeers sets
+func relayPeerChanged(cur wgtypes.Peer, want wgtypes.PeerConfig) bool {
+	if cur.PresharedKey != (wgtypes.Key{}) {
+		return true
+	}
+	if cur.Endpoint == nil || !cur.Endpoint.IP.Equal(want.Endpoint.IP) || cur.Endpoint.Port != want.Endpoint.Port {
+		return true
+	}
+	if cur.PersistentKeepaliveInterval != *want.PersistentKeepaliveInterval {
+		return true
+	}
+	if len(cur.AllowedIPs) != len(want.AllowedIPs) {
+		return true
+	}
+	cur_ips := make(map[string]bool, len(cur.AllowedIPs))
+	for _, a := range cur.AllowedIPs {
+		cur_ips[a.String()] = true
+	}
+	for _, a := range want.AllowedIPs {
+		if !cur_ips[a.String()] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,229 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// RelayRow is one relay as served by the control server's /relay-table
+type RelayRow struct {
+	ServerID   uint64       `json:"id"`
+	ServerName string       `json:"name,omitempty"`
+	PubIP      netip.Addr   `json:"pub_ip"`
+	Port       uint16       `json:"port"`
+	PrivIP     netip.Addr   `json:"priv_ip"`
+	Subnet     netip.Prefix `json:"subnet"`
+	PubKey     []byte       `json:"pub_key"`
+}
+
+// SyncReport lists the relays touched by a sync, as "id (name)"
+type SyncReport struct {
+	Added   []string `json:"added"`
+	Changed []string `json:"changed"`
+	Removed []string `json:"removed"`
+}
+
+// newControlClient builds an mTLS client for the control server.
+// cert_dir holds ca.crt plus this client's client.crt / client.key.
+func newControlClient(cert_dir string) (*http.Client, error) {
+	caPem, err := os.ReadFile(filepath.Join(cert_dir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("read ca: %w", err)
+	}
+	caPool := x509.NewCertPool()
+	if !caPool.AppendCertsFromPEM(caPem) {
+		return nil, errors.New("failed to append CA cert")
+	}
+	clientCert, err := tls.LoadX509KeyPair(
+		filepath.Join(cert_dir, "client.crt"),
+		filepath.Join(cert_dir, "client.key"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("load client cert: %w", err)
+	}
+
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				Certificates: []tls.Certificate{clientCert},
+				RootCAs:      caPool,
+				MinVersion:   tls.VersionTLS13,
+			},
+		},
+	}, nil
+}
+
+// FetchRelayTable downloads the relay list from the control server, e.g. https://10.0.12.1:8089
+func FetchRelayTable(ctx context.Context, control_url string, cert_dir string) ([]RelayRow, error) {
+	httpClient, err := newControlClient(cert_dir)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(control_url, "/")+"/relay-table", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch relay table: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch relay table: %s", resp.Status)
+	}
+
+	var relays []RelayRow
+	if err := json.NewDecoder(resp.Body).Decode(&relays); err != nil {
+		return nil, fmt.Errorf("decode relay table: %w", err)
+	}
+	return relays, nil
+}
+
+// SyncRelayTable makes the local server_info_table match relays in a single transaction.
+// Rows are keyed by the server_id the control server hands out.
+func SyncRelayTable(ctx context.Context, db *sql.DB, relays []RelayRow) (SyncReport, error) {
+	report := SyncReport{Added: []string{}, Changed: []string{}, Removed: []string{}}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return report, err
+	}
+	defer tx.Rollback()
+
+	// current local state
+	rows, err := tx.QueryContext(ctx, `
+		SELECT server_id, server_name, server_pubip, server_port, server_privip, server_subnet, server_pubkey
+		FROM server_info_table`)
+	if err != nil {
+		return report, err
+	}
+	current := make(map[uint64]RelayRow)
+	for rows.Next() {
+		var row RelayRow
+		var name, subnet sql.NullString
+		var pub_ip, priv_ip []byte
+		if err := rows.Scan(&row.ServerID, &name, &pub_ip, &row.Port, &priv_ip, &subnet, &row.PubKey); err != nil {
+			rows.Close()
+			return report, err
+		}
+		row.ServerName = name.String
+		row.PubIP = addrFromBlob(pub_ip)
+		row.PrivIP = addrFromBlob(priv_ip)
+		row.Subnet, _ = netip.ParsePrefix(subnet.String)
+		current[row.ServerID] = row
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+
+	wanted := make(map[uint64]bool, len(relays))
+	for _, r := range relays {
+		wanted[r.ServerID] = true
+	}
+
+	// removals go first so a relay re-added under a new id does not trip the UNIQUE columns
+	for id, row := range current {
+		if wanted[id] {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM server_info_table WHERE server_id = ?`, id); err != nil {
+			return report, fmt.Errorf("delete relay %d: %w", id, err)
+		}
+		report.Removed = append(report.Removed, relayLabel(row))
+	}
+
+	// the relay table carries no preshared key, relays only use one among themselves
+	const upsert_sql = `
+		INSERT INTO server_info_table
+			(server_id, server_name, server_pubip, server_port, server_privip, server_subnet, server_pubkey, server_presharedkey)
+		VALUES (?, ?, ?, ?, ?, ?, ?, x'')
+		ON CONFLICT(server_id) DO UPDATE SET
+			server_name   = excluded.server_name,
+			server_pubip  = excluded.server_pubip,
+			server_port   = excluded.server_port,
+			server_privip = excluded.server_privip,
+			server_subnet = excluded.server_subnet,
+			server_pubkey = excluded.server_pubkey;`
+
+	for _, r := range relays {
+		old, exists := current[r.ServerID]
+		if exists && relayEqual(old, r) {
+			continue
+		}
+		if !r.PubIP.IsValid() || !r.PrivIP.IsValid() {
+			return report, fmt.Errorf("relay %d has no address", r.ServerID)
+		}
+		var subnet sql.NullString
+		if r.Subnet.IsValid() {
+			subnet = sql.NullString{String: r.Subnet.String(), Valid: true}
+		}
+		if _, err := tx.ExecContext(ctx, upsert_sql,
+			r.ServerID, r.ServerName, addrToBlob(r.PubIP), r.Port, addrToBlob(r.PrivIP), subnet, r.PubKey); err != nil {
+			return report, fmt.Errorf("upsert relay %d: %w", r.ServerID, err)
+		}
+		if exists {
+			report.Changed = append(report.Changed, relayLabel(r))
+		} else {
+			report.Added = append(report.Added, relayLabel(r))
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// FetchServerInfo downloads the relay table and stores it in the local database
+func FetchServerInfo(db *sql.DB, control_url string, cert_dir string) (SyncReport, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	relays, err := FetchRelayTable(ctx, control_url, cert_dir)
+	if err != nil {
+		return SyncReport{}, err
+	}
+	return SyncRelayTable(ctx, db, relays)
+}
+
+func relayEqual(a, b RelayRow) bool {
+	return a.ServerName == b.ServerName &&
+		a.Port == b.Port &&
+		a.PubIP == b.PubIP &&
+		a.PrivIP == b.PrivIP &&
+		a.Subnet == b.Subnet &&
+		bytes.Equal(a.PubKey, b.PubKey)
+}
+
+// addresses are kept as 16 bytes in the local database, IPv4 in its mapped form
+func addrToBlob(addr netip.Addr) []byte {
+	b := addr.As16()
+	return b[:]
+}
+
+func addrFromBlob(b []byte) netip.Addr {
+	addr, _ := netip.AddrFromSlice(b)
+	return addr.Unmap()
+}
+
+func relayLabel(r RelayRow) string {
+	if r.ServerName == "" {
+		return fmt.Sprintf("%d", r.ServerID)
+	}
+	return fmt.Sprintf("%d (%s)", r.ServerID, r.ServerName)
+}
@@ -0,0 +1,106 @@
+package client
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// ──────────── LoadOrCreateIdentity ─────────────────────────────────────
+// Returns the client's WireGuard private key from identity_table.
+// • First run: imported from seed when one is configured, else generated.
+// • Later runs: always the stored key, so the public key keeps matching
+// the user_pubkey registered with `gdim adduser`.
+func LoadOrCreateIdentity(db *sql.DB, seed string) (wgtypes.Key, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var stored []byte
+	err := db.QueryRowContext(ctx, `SELECT wg_privkey FROM identity_table WHERE id = 1`).Scan(&stored)
+	if err == nil {
+		key, err := wgtypes.NewKey(stored)
+		if err != nil {
+			return wgtypes.Key{}, fmt.Errorf("stored identity is corrupt: %w", err)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return wgtypes.Key{}, fmt.Errorf("read identity: %w", err)
+	}
+
+	var key wgtypes.Key
+	if len(seed) != 0 {
+		key, err = wgtypes.ParseKey(seed)
+	} else {
+		key, err = wgtypes.GeneratePrivateKey()
+	}
+	if err != nil {
+		return wgtypes.Key{}, err
+	}
+
+	// OR IGNORE: if another process won the race, re-read its key below
+	if _, err := db.ExecContext(ctx,
+		`INSERT OR IGNORE INTO identity_table (id, wg_privkey) VALUES (1, ?)`, key[:]); err != nil {
+		return wgtypes.Key{}, fmt.Errorf("store identity: %w", err)
+	}
+	if err := db.QueryRowContext(ctx, `SELECT wg_privkey FROM identity_table WHERE id = 1`).Scan(&stored); err != nil {
+		return wgtypes.Key{}, fmt.Errorf("read identity: %w", err)
+	}
+	return wgtypes.NewKey(stored)
+}
+
+// ──────────── LoadOrCreateSigningKey ───────────────────────────────────
+// Returns the ed25519 key the client signs control-plane challenges with
+// (e.g. /ip/replace), generating and storing it on first use.
+func LoadOrCreateSigningKey(db *sql.DB) (ed25519.PrivateKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var seed []byte
+	err := db.QueryRowContext(ctx, `SELECT sign_seed FROM signing_key_table WHERE id = 1`).Scan(&seed)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("read signing key: %w", err)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		seed = make([]byte, ed25519.SeedSize)
+		if _, err := rand.Read(seed); err != nil {
+			return nil, err
+		}
+		if _, err := db.ExecContext(ctx,
+			`INSERT OR IGNORE INTO signing_key_table (id, sign_seed) VALUES (1, ?)`, seed); err != nil {
+			return nil, fmt.Errorf("store signing key: %w", err)
+		}
+		if err := db.QueryRowContext(ctx, `SELECT sign_seed FROM signing_key_table WHERE id = 1`).Scan(&seed); err != nil {
+			return nil, fmt.Errorf("read signing key: %w", err)
+		}
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.New("stored signing key is corrupt")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// ──────────── SigningKeyAge ────────────────────────────────────────────
+// Reports how long ago the current signing key was created, so callers can
+// rotate it on their own schedule.
+func SigningKeyAge(db *sql.DB) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var created string
+	if err := db.QueryRowContext(ctx, `SELECT created_at FROM signing_key_table WHERE id = 1`).Scan(&created); err != nil {
+		return 0, fmt.Errorf("read signing key: %w", err)
+	}
+	// datetime('now') is UTC without a zone suffix
+	t, err := time.Parse(time.DateTime, created)
+	if err != nil {
+		return 0, fmt.Errorf("parse signing key age: %w", err)
+	}
+	return time.Since(t), nil
+}
@@ -4,21 +4,71 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"os"
 	"time"
 
 	_ "modernc.org/sqlite" // pure‑Go SQLite driver, no CGO needed
 )
 
-// InitializeLocalDB opens (or creates) a portable SQLite file and makes sure
-// the required table exists. The returned *sql.DB has sane connection limits
-// for an embedded, single‑user scenario.
-//
-//	db, err := InitializeLocalDB("/home/alice/.guardedim/client.db")
-//	if err != nil { … }
-//	defer db.Close()
-func InitializeLocalDB(path string) (*sql.DB, error) {
-	// SQLite DSN — _pragma busy_timeout_ helps when the file is on network fs.
-	dsn := fmt.Sprintf("file:%s?_busy_timeout=5000&_journal_mode=WAL", path)
+// localMigrations is the SQLite schema history, append new steps with the next
+// version and never edit one that has shipped.
+var localMigrations = []localMigration{
+	{Version: 1, Name: "create server_info_table", Statements: []string{`
+CREATE TABLE IF NOT EXISTS server_info_table (
+  server_id           INTEGER       PRIMARY KEY AUTOINCREMENT,
+  server_name         TEXT          COLLATE NOCASE,         -- STRING(64)
+  server_pubip        BLOB          NOT NULL,               -- BYTES
+  server_port         INTEGER       NOT NULL CHECK (server_port BETWEEN 0 AND 65535),
+  server_privip       BLOB          NOT NULL UNIQUE,
+  server_pubkey       BLOB          NOT NULL UNIQUE,
+  server_presharedkey BLOB          NOT NULL
+);`}},
+	// single row holding this client's long-lived WireGuard identity
+	{Version: 2, Name: "create identity_table", Statements: []string{`
+CREATE TABLE IF NOT EXISTS identity_table (
+  id                  INTEGER       PRIMARY KEY CHECK (id = 1),
+  wg_privkey          BLOB          NOT NULL,               -- 32 bytes
+  created_at          TEXT          NOT NULL DEFAULT (datetime('now'))
+);`}},
+	// single row holding the ed25519 key that signs control-plane requests
+	{Version: 3, Name: "create signing_key_table", Statements: []string{`
+CREATE TABLE IF NOT EXISTS signing_key_table (
+  id                  INTEGER       PRIMARY KEY CHECK (id = 1),
+  sign_seed           BLOB          NOT NULL,               -- ed25519 seed, 32 bytes
+  created_at          TEXT          NOT NULL DEFAULT (datetime('now'))
+);`}},
+	// the CIDR block each relay serves, from the relay table
+	{Version: 4, Name: "add server_subnet", Statements: []string{`
+ALTER TABLE server_info_table ADD COLUMN server_subnet TEXT;`}},
+	// single row holding an enrollment waiting for approval, so gdim join / enroll can resume polling
+	{Version: 5, Name: "create pending_enrollment_table", Statements: []string{`
+CREATE TABLE IF NOT EXISTS pending_enrollment_table (
+  id                  INTEGER       PRIMARY KEY CHECK (id = 1),
+  control_url         TEXT          NOT NULL,
+  token               TEXT          NOT NULL,               -- the invite the request was filed with
+  request_id          INTEGER       NOT NULL,
+  secret              TEXT          NOT NULL,               -- proves the request is ours to /enroll/status
+  created_at          TEXT          NOT NULL DEFAULT (datetime('now'))
+);`}},
+}
+
+// OpenLocalDB opens (or creates) a portable SQLite file without touching its
+// schema. The returned *sql.DB has sane connection limits for an embedded,
+// single‑user scenario.
+func OpenLocalDB(path string) (*sql.DB, error) {
+	// the file holds the private key: create it for the owner only before SQLite opens it,
+	// SQLite gives its journal and WAL files the same mode; older files are tightened too
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open local db: %w", err)
+	}
+	f.Close()
+	if err := os.Chmod(path, 0600); err != nil {
+		return nil, fmt.Errorf("chmod local db: %w", err)
+	}
+
+	// SQLite DSN — busy_timeout helps when the file is on network fs; modernc takes pragmas as _pragma
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)", path)
 
 	db, err := sql.Open("sqlite", dsn)
 	if err != nil {
@@ -30,23 +80,32 @@ func InitializeLocalDB(path string) (*sql.DB, error) {
 	db.SetMaxIdleConns(1)
 	db.SetConnMaxIdleTime(5 * time.Minute)
 
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("open sqlite: %w", err)
+	}
+
+	return db, nil
+}
+
+// InitializeLocalDB opens (or creates) the local database and applies every
+// pending schema migration.
+//
+//	db, err := InitializeLocalDB("/home/alice/.guardedim/client.db")
+//	if err != nil { … }
+//	defer db.Close()
+func InitializeLocalDB(path string) (*sql.DB, error) {
+	db, err := OpenLocalDB(path)
+	if err != nil {
+		return nil, err
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	const ddl = `
-CREATE TABLE IF NOT EXISTS server_info_table (
-  server_id           INTEGER       PRIMARY KEY AUTOINCREMENT,
-  server_name         TEXT          COLLATE NOCASE,         -- STRING(64)
-  server_pubip        BLOB          NOT NULL,               -- BYTES
-  server_port         INTEGER       NOT NULL CHECK (server_port BETWEEN 0 AND 65535),
-  server_privip       BLOB          NOT NULL UNIQUE,
-  server_pubkey       BLOB          NOT NULL UNIQUE,
-  server_presharedkey BLOB          NOT NULL
-);`
-	if _, err = db.ExecContext(ctx, ddl); err != nil {
+	if _, err := MigrateLocalDB(ctx, db); err != nil {
 		db.Close()
-		return nil, fmt.Errorf("create table: %w", err)
+		return nil, err
 	}
-
 	return db, nil
 }
@@ -4,12 +4,14 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"net"
+	"guardedim/overlay"
+	"net/netip"
 
 	"github.com/vishvananda/netlink"
 	"golang.org/x/sys/unix"
 	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/ipc"
 	"golang.zx2c4.com/wireguard/tun"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
@@ -18,7 +20,8 @@ import (
 // Creates a userspace WireGuard interface for a **client**.
 // • No ListenPort: outbound UDP uses an ephemeral port.
 // • If wg_privkey is empty, a fresh key is generated.
-func createWG0Client(wg_privkey string) (*device.Device, error) {
+// • The interface is named iface and created with the TUN MTU mtu.
+func createWG0Client(iface string, mtu int, wg_privkey string) (*device.Device, error) {
 
 	// declare the variables beforehand to prevent shadowing
 	var key wgtypes.Key
@@ -39,76 +42,99 @@ func createWG0Client(wg_privkey string) (*device.Device, error) {
 
 	wg_privkey = hex.EncodeToString(key[:])
 
-	tun_dev, err := tun.CreateTUN("wg0", 1500)
+	tun_dev, err := tun.CreateTUN(iface, mtu)
 	if err != nil {
 		return nil, err
 	}
 
 	bind := conn.NewDefaultBind()
-	logger := device.NewLogger(device.LogLevelVerbose, "wg0: ")
+	logger := device.NewLogger(device.LogLevelVerbose, iface+": ")
 	wgDev := device.NewDevice(tun_dev, bind, logger)
 	go wgDev.RoutineTUNEventReader()
 
+	// UAPI socket, ConfigureServerPeers drives the device through wgctrl
+	uapiFile, err := ipc.UAPIOpen(iface)
+	if err != nil {
+		wgDev.Close()
+		return nil, err
+	}
+	uapi, err := ipc.UAPIListen(iface, uapiFile)
+	if err != nil {
+		wgDev.Close()
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := uapi.Accept()
+			if err != nil {
+				return
+			}
+			go wgDev.IpcHandle(conn)
+		}
+	}()
+	go func() {
+		<-wgDev.Wait()
+		uapi.Close()
+	}()
+
 	cfg := fmt.Sprintf("private_key=%s\n", wg_privkey)
 	return wgDev, wgDev.IpcSet(cfg)
 }
 
 // ──────────── setupWG0LinuxClient ─────────────────────────────────────
-// Assigns the client's IP, sets MTU (default 1280), and brings the link UP.
-func setupWG0LinuxClient(clientIP string, MTU int) error {
-	ip := net.ParseIP(clientIP)
-	if ip == nil {
+// Assigns the client's IP, sets ov.MTU, brings the link UP and routes the
+// overlay supernet into it. With a ULA prefix the client also gets the IPv6
+// address embedding its IPv4 one and the prefix is routed as well.
+func setupWG0LinuxClient(ov overlay.Config, clientIP string) error {
+	ip, err := netip.ParseAddr(clientIP)
+	if err != nil || !ip.Is4() || !ov.Supernet.Contains(ip) {
 		return errors.New("invalid client IP")
 	}
+	ipNets := overlay.IPNets(ov.DualStack(ip)...)
 
-	var ipNet *net.IPNet
-	if v4 := ip.To4(); v4 != nil {
-		ipNet = &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}
-	} else {
-		ip16 := ip.To16()
-		ipNet = &net.IPNet{IP: ip16, Mask: net.CIDRMask(128, 128)}
-	}
-
-	if MTU == 0 {
-		MTU = 1500
-	}
-	if MTU < 800 || MTU > 1700 {
-		return errors.New("MTU out of reasonable range")
-	}
-
-	link, err := netlink.LinkByName("wg0")
+	link, err := netlink.LinkByName(ov.Interface)
 	if err != nil {
 		return err
 	}
 
-	if err := netlink.AddrAdd(link, &netlink.Addr{IPNet: ipNet}); err != nil {
-		return err
+	for i := range ipNets {
+		addr := &netlink.Addr{IPNet: &ipNets[i]}
+		if ipNets[i].IP.To4() == nil {
+			addr.Flags = unix.IFA_F_NODAD
+		}
+		if err := netlink.AddrAdd(link, addr); err != nil {
+			return err
+		}
 	}
 	if err := netlink.LinkSetUp(link); err != nil {
 		return err
 	}
-	if err := netlink.LinkSetMTU(link, MTU); err != nil {
+	if err := netlink.LinkSetMTU(link, ov.MTU); err != nil {
 		return err
 	}
-	route := &netlink.Route{
-		LinkIndex: link.Attrs().Index,
-		Dst:       &net.IPNet{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
-	}
-	if err := netlink.RouteAdd(route); err != nil && !errors.Is(err, unix.EEXIST) {
-		return err
+	routes := ov.RouteIPNets()
+	for i := range routes {
+		route := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       &routes[i],
+		}
+		if err := netlink.RouteAdd(route); err != nil && !errors.Is(err, unix.EEXIST) {
+			return err
+		}
 	}
 	return nil
 }
 
 // ──────────── InitializeInterface (client) ─────────────────────────────
-// Convenience wrapper that creates wg0 and configures IP/MTU.
+// Convenience wrapper that creates ov.Interface and configures IP/MTU.
 // Returns the *device.Device so the caller can add peers later.
-func InitializeInterface(clientIP, wg_privkey string, MTU int) (*device.Device, error) {
-	wgDev, err := createWG0Client(wg_privkey)
+func InitializeInterface(ov overlay.Config, clientIP, wg_privkey string) (*device.Device, error) {
+	wgDev, err := createWG0Client(ov.Interface, ov.MTU, wg_privkey)
 	if err != nil {
 		return nil, err
 	}
-	if err = setupWG0LinuxClient(clientIP, MTU); err != nil {
+	if err = setupWG0LinuxClient(ov, clientIP); err != nil {
+		wgDev.Close()
 		return nil, err
 	}
 	return wgDev, nil
@@ -1 +1,243 @@
 package client
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Invite is an invite token issued by the control server
+type Invite struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// EnrollResult is the control server's answer to /enroll and /enroll/status
+type EnrollResult struct {
+	UserID          uint64       `json:"user_id"`
+	LatestIP        netip.Addr   `json:"latest_ip"`
+	Relays          []RelayRow   `json:"relays"`
+	OverlaySupernet netip.Prefix `json:"overlay_supernet"`
+	OverlayULA      netip.Prefix `json:"overlay_ula_prefix"`
+	Certificate     string       `json:"certificate,omitempty"` // client certificate, empty if the server issues none
+
+	Status    string `json:"status"` // pending, approved or rejected; empty from older servers
+	RequestID int64  `json:"request_id,omitempty"`
+	Secret    string `json:"secret,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// ErrEnrollmentPending means the control server filed the enrollment for an admin's approval,
+// calling Enroll again polls it
+var ErrEnrollmentPending = errors.New("enrollment is waiting for an admin's approval")
+
+// ──────────── InviteNewUser ────────────────────────────────────────────
+// Asks the control server for an invite on behalf of this user through
+// /invite/create:
+//  1. POST {user_id, ttl_seconds}       → {nonce}
+//  2. POST {user_id, ttl_seconds, sig}  → {token, expires_at}
+//
+// where sig is the ed25519 signature of nonce‖"/invite/create"‖0‖ttl_seconds
+// in decimal. The invitee
+// ends up on this user's home relay; the server rate limits invites per user.
+func InviteNewUser(ctx context.Context, control_url string, cert_dir string, user_id uint64, ttl time.Duration, sign_key ed25519.PrivateKey) (Invite, error) {
+	type request struct {
+		UserID     uint64 `json:"user_id"`
+		TTLSeconds int64  `json:"ttl_seconds,omitempty"`
+		SigB64     string `json:"sig,omitempty"`
+	}
+	type respChallenge struct {
+		Nonce string `json:"nonce"`
+	}
+	var invite Invite
+
+	httpClient, err := newControlClient(cert_dir)
+	if err != nil {
+		return invite, err
+	}
+	ttl_seconds := int64(ttl / time.Second)
+
+	// ---- Phase 1: challenge ----
+	var challenge respChallenge
+	if err := postControl(ctx, httpClient, control_url, "/invite/create",
+		request{UserID: user_id, TTLSeconds: ttl_seconds}, &challenge); err != nil {
+		return invite, err
+	}
+	nonce, err := hex.DecodeString(challenge.Nonce)
+	if err != nil || len(nonce) == 0 {
+		return invite, errors.New("server sent a malformed nonce")
+	}
+
+	// ---- Phase 2: signed response ----
+	sig := ed25519.Sign(sign_key, signedMessage(nonce, "/invite/create", []byte(strconv.FormatInt(ttl_seconds, 10))))
+	err = postControl(ctx, httpClient, control_url, "/invite/create",
+		request{UserID: user_id, TTLSeconds: ttl_seconds, SigB64: base64.StdEncoding.EncodeToString(sig)}, &invite)
+	return invite, err
+}
+
+// NewEnrollClient builds a client for /enroll: it verifies the control server
+// against ca_file but, unlike newControlClient, presents no client certificate.
+func NewEnrollClient(ca_file string) (*http.Client, error) {
+	caPem, err := os.ReadFile(ca_file)
+	if err != nil {
+		return nil, fmt.Errorf("read ca: %w", err)
+	}
+	return newCAClient(caPem)
+}
+
+// newCAClient is an HTTPS client trusting only caPem, without a client certificate
+func newCAClient(caPem []byte) (*http.Client, error) {
+	caPool := x509.NewCertPool()
+	if !caPool.AppendCertsFromPEM(caPem) {
+		return nil, errors.New("failed to append CA cert")
+	}
+	return &http.Client{
+		Timeout: 15 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs:    caPool,
+				MinVersion: tls.VersionTLS13,
+			},
+		},
+	}, nil
+}
+
+// ──────────── Enroll ───────────────────────────────────────────────────
+// Redeems an invite token as a new user. The WireGuard identity and the
+// signing key come from the local database (created on first use), so the
+// keys the server registers are the ones gdimd will use. On success the
+// returned relay table is stored in the local server_info_table.
+//
+// With a cert_dir, a certificate request for client.key there (created on
+// first use) goes along, and the client certificate the server returns is
+// written to client.crt next to it.
+//
+// When the server wants an admin's approval first, the request is kept in
+// pending_enrollment_table and ErrEnrollmentPending returned; later calls
+// with the same control_url and token poll /enroll/status instead.
+func Enroll(ctx context.Context, db *sql.DB, httpClient *http.Client, control_url string, cert_dir string, token string, username string, display_name string) (EnrollResult, error) {
+	type request struct {
+		Token       string `json:"token"`
+		Username    string `json:"username"`
+		DisplayName string `json:"display_name,omitempty"`
+		PubKey      string `json:"pub_key"`
+		SigningKey  string `json:"signing_key"`
+		CSR         string `json:"csr,omitempty"`
+	}
+	var result EnrollResult
+
+	identity, err := LoadOrCreateIdentity(db, "")
+	if err != nil {
+		return result, err
+	}
+	sign_key, err := LoadOrCreateSigningKey(db)
+	if err != nil {
+		return result, err
+	}
+
+	pending, found, err := loadPendingEnrollment(ctx, db)
+	if err != nil {
+		return result, err
+	}
+	if found && pending.control_url == control_url && pending.token == token {
+		err = postControl(ctx, httpClient, control_url, "/enroll/status", pending.status, &result)
+	} else {
+		var csr string
+		if len(cert_dir) != 0 {
+			if csr, err = newClientCSR(cert_dir, username); err != nil {
+				return result, err
+			}
+		}
+		err = postControl(ctx, httpClient, control_url, "/enroll", request{
+			Token:       token,
+			Username:    username,
+			DisplayName: display_name,
+			PubKey:      identity.PublicKey().String(),
+			SigningKey:  base64.StdEncoding.EncodeToString(sign_key.Public().(ed25519.PublicKey)),
+			CSR:         csr,
+		}, &result)
+	}
+	if err != nil {
+		return result, err
+	}
+
+	switch result.Status {
+	case "pending":
+		if len(result.Secret) != 0 {
+			if err := storePendingEnrollment(ctx, db, control_url, token, result); err != nil {
+				return result, fmt.Errorf("enrollment request %d filed but not stored: %w", result.RequestID, err)
+			}
+		}
+		return result, ErrEnrollmentPending
+	case "rejected":
+		_ = clearPendingEnrollment(ctx, db)
+		if len(result.Reason) != 0 {
+			return result, fmt.Errorf("enrollment request %d rejected: %s", result.RequestID, result.Reason)
+		}
+		return result, fmt.Errorf("enrollment request %d rejected", result.RequestID)
+	}
+	if result.UserID == 0 || !result.LatestIP.IsValid() {
+		return result, errors.New("server sent an incomplete enrollment")
+	}
+	if len(result.Certificate) != 0 && len(cert_dir) != 0 {
+		if err := storeClientCert(cert_dir, result.Certificate); err != nil {
+			return result, fmt.Errorf("enrolled as user %d but storing the client certificate failed: %w", result.UserID, err)
+		}
+	}
+	if err := clearPendingEnrollment(ctx, db); err != nil {
+		return result, err
+	}
+
+	if _, err := SyncRelayTable(ctx, db, result.Relays); err != nil {
+		return result, fmt.Errorf("enrolled as user %d but storing the relay table failed, run fetchserverinfo: %w", result.UserID, err)
+	}
+	return result, nil
+}
+
+// pendingEnrollment is the row of pending_enrollment_table
+type pendingEnrollment struct {
+	control_url string
+	token       string
+	status      struct {
+		RequestID int64  `json:"request_id"`
+		Secret    string `json:"secret"`
+	}
+}
+
+func loadPendingEnrollment(ctx context.Context, db *sql.DB) (pendingEnrollment, bool, error) {
+	var p pendingEnrollment
+	err := db.QueryRowContext(ctx, `
+		SELECT control_url, token, request_id, secret FROM pending_enrollment_table WHERE id = 1`).
+		Scan(&p.control_url, &p.token, &p.status.RequestID, &p.status.Secret)
+	if errors.Is(err, sql.ErrNoRows) {
+		return p, false, nil
+	}
+	if err != nil {
+		return p, false, fmt.Errorf("read pending enrollment: %w", err)
+	}
+	return p, true, nil
+}
+
+// storePendingEnrollment replaces whatever request was stored before
+func storePendingEnrollment(ctx context.Context, db *sql.DB, control_url string, token string, result EnrollResult) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT OR REPLACE INTO pending_enrollment_table (id, control_url, token, request_id, secret)
+		VALUES (1, ?, ?, ?, ?)`, control_url, token, result.RequestID, result.Secret)
+	return err
+}
+
+func clearPendingEnrollment(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM pending_enrollment_table`)
+	return err
+}
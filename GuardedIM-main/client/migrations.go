@@ -0,0 +1,123 @@
+package client
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// localMigration is one versioned step of the SQLite schema, applied in a single transaction
+type localMigration struct {
+	Version    int
+	Name       string
+	Statements []string
+}
+
+// MigrationState tells whether a migration has been applied, AppliedAt is nil while it is pending
+type MigrationState struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+const schemaMigrationsDDL = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+  version             INTEGER       PRIMARY KEY,
+  name                TEXT          NOT NULL,
+  applied_at          TEXT          NOT NULL DEFAULT (datetime('now'))
+);`
+
+// appliedLocalMigrations reads schema_migrations, creating it on first use
+func appliedLocalMigrations(ctx context.Context, db *sql.DB) (map[int]MigrationState, error) {
+	if _, err := db.ExecContext(ctx, schemaMigrationsDDL); err != nil {
+		return nil, fmt.Errorf("create schema_migrations: %w", err)
+	}
+	rows, err := db.QueryContext(ctx, `SELECT version, name, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]MigrationState)
+	for rows.Next() {
+		var m MigrationState
+		var applied_at string
+		if err := rows.Scan(&m.Version, &m.Name, &applied_at); err != nil {
+			return nil, err
+		}
+		if t, err := time.Parse(time.DateTime, applied_at); err == nil {
+			m.AppliedAt = &t
+		} else {
+			m.AppliedAt = &time.Time{}
+		}
+		applied[m.Version] = m
+	}
+	return applied, rows.Err()
+}
+
+// LocalMigrationStatus lists every known migration along with versions recorded by a newer gdim, oldest first
+func LocalMigrationStatus(ctx context.Context, db *sql.DB) ([]MigrationState, error) {
+	applied, err := appliedLocalMigrations(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	var states []MigrationState
+	for _, m := range localMigrations {
+		state := MigrationState{Version: m.Version, Name: m.Name}
+		if a, ok := applied[m.Version]; ok {
+			state.AppliedAt = a.AppliedAt
+			delete(applied, m.Version)
+		}
+		states = append(states, state)
+	}
+	for _, a := range applied {
+		states = append(states, a)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Version < states[j].Version })
+	return states, nil
+}
+
+// MigrateLocalDB applies every pending migration in version order, each one together
+// with its schema_migrations row in a single transaction.
+// Returns the migrations applied by this call.
+func MigrateLocalDB(ctx context.Context, db *sql.DB) ([]MigrationState, error) {
+	applied, err := appliedLocalMigrations(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []MigrationState
+	for _, m := range localMigrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		if err := applyLocalMigration(ctx, db, m); err != nil {
+			return done, fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		now := time.Now().UTC()
+		done = append(done, MigrationState{Version: m.Version, Name: m.Name, AppliedAt: &now})
+	}
+	return done, nil
+}
+
+func applyLocalMigration(ctx context.Context, db *sql.DB, m localMigration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, q := range m.Statements {
+		if _, err := tx.ExecContext(ctx, q); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name) VALUES (?, ?)`,
+		m.Version, m.Name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,132 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ReplaceIPResult is the server's answer to a signed /ip/replace request
+type ReplaceIPResult struct {
+	Free      bool   `json:"free"`
+	Written   bool   `json:"written"`
+	IPAddress string `json:"ip_address"`
+}
+
+// postControl POSTs body as JSON to the control server and decodes the JSON reply into out
+func postControl(ctx context.Context, httpClient *http.Client, control_url string, path string, body any, out any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(control_url, "/")+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s: %s: %s", path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// signedMessage is what the control server expects a signed request to cover:
+// the challenge nonce, the endpoint and the request's parameters
+func signedMessage(nonce []byte, path string, payload []byte) []byte {
+	msg := make([]byte, 0, len(nonce)+len(path)+1+len(payload))
+	msg = append(msg, nonce...)
+	msg = append(msg, path...)
+	msg = append(msg, 0)
+	return append(msg, payload...)
+}
+
+// ──────────── ReplaceIP ────────────────────────────────────────────────
+// Runs both phases of the control server's /ip/replace exchange:
+//  1. POST {user_id, ip_address}       → {nonce}
+//  2. POST {user_id, ip_address, sig}  → {free, written, ip_address}
+//
+// where sig is the ed25519 signature of nonce‖"/ip/replace"‖0‖ip_address.
+// An empty ip lets the server pick a free address of the home relay subnet.
+func ReplaceIP(ctx context.Context, control_url string, cert_dir string, user_id uint64, ip string, sign_key ed25519.PrivateKey) (ReplaceIPResult, error) {
+	httpClient, err := newControlClient(cert_dir)
+	if err != nil {
+		return ReplaceIPResult{}, err
+	}
+	return replaceIP(ctx, httpClient, control_url, user_id, ip, sign_key)
+}
+
+func replaceIP(ctx context.Context, httpClient *http.Client, control_url string, user_id uint64, ip string, sign_key ed25519.PrivateKey) (ReplaceIPResult, error) {
+	type request struct {
+		UserID    uint64 `json:"user_id"`
+		IPAddress string `json:"ip_address"`
+		SigB64    string `json:"sig,omitempty"`
+	}
+	type respChallenge struct {
+		Nonce string `json:"nonce"`
+	}
+	var result ReplaceIPResult
+
+	// ---- Phase 1: challenge ----
+	var challenge respChallenge
+	if err := postControl(ctx, httpClient, control_url, "/ip/replace",
+		request{UserID: user_id, IPAddress: ip}, &challenge); err != nil {
+		return result, err
+	}
+	nonce, err := hex.DecodeString(challenge.Nonce)
+	if err != nil || len(nonce) == 0 {
+		return result, errors.New("server sent a malformed nonce")
+	}
+
+	// ---- Phase 2: signed response ----
+	sig := ed25519.Sign(sign_key, signedMessage(nonce, "/ip/replace", []byte(ip)))
+	err = postControl(ctx, httpClient, control_url, "/ip/replace",
+		request{UserID: user_id, IPAddress: ip, SigB64: base64.StdEncoding.EncodeToString(sig)}, &result)
+	return result, err
+}
+
+// ──────────── ClaimOverlayIP ───────────────────────────────────────────
+// Claims wanted as this user's overlay address. If another user holds it,
+// the server allocates a free address of the home relay subnet instead.
+// Returns the address that is now recorded as latest_ip.
+func ClaimOverlayIP(ctx context.Context, control_url string, cert_dir string, user_id uint64, wanted string, sign_key ed25519.PrivateKey) (string, error) {
+	ip, err := netip.ParseAddr(wanted)
+	if err != nil || !ip.Is4() {
+		return "", errors.New("invalid overlay IPv4 address")
+	}
+	httpClient, err := newControlClient(cert_dir)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := replaceIP(ctx, httpClient, control_url, user_id, ip.String(), sign_key)
+	if err != nil {
+		return "", err
+	}
+	if !res.Free {
+		log.Printf("overlay address %s is taken, asking for another one", ip)
+		if res, err = replaceIP(ctx, httpClient, control_url, user_id, "", sign_key); err != nil {
+			return "", err
+		}
+	}
+	if !res.Free || !res.Written || res.IPAddress == "" {
+		return "", fmt.Errorf("server did not record an address for user %d", user_id)
+	}
+	return res.IPAddress, nil
+}
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// ──────────── RotateSigningKey ─────────────────────────────────────────
+// Replaces the client's ed25519 signing key through /identity/rotate:
+//  1. POST {user_id, new_pubkey}                → {nonce}
+//  2. POST {user_id, new_pubkey, sig, new_sig}  → {rotated}
+//
+// Both signatures cover nonce‖"/identity/rotate"‖0‖new_pubkey; sig is made with the current key,
+// new_sig with the new one. The new seed is only stored locally once the
+// server has accepted it. Returns the new public key.
+func RotateSigningKey(ctx context.Context, db *sql.DB, control_url string, cert_dir string, user_id uint64) (ed25519.PublicKey, error) {
+	type request struct {
+		UserID    uint64 `json:"user_id"`
+		NewPubKey string `json:"new_pubkey"`
+		SigB64    string `json:"sig,omitempty"`
+		NewSigB64 string `json:"new_sig,omitempty"`
+	}
+	type respChallenge struct {
+		Nonce string `json:"nonce"`
+	}
+	type respResult struct {
+		Rotated bool `json:"rotated"`
+	}
+
+	old_key, err := LoadOrCreateSigningKey(db)
+	if err != nil {
+		return nil, err
+	}
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, err
+	}
+	new_key := ed25519.NewKeyFromSeed(seed)
+	new_pub := new_key.Public().(ed25519.PublicKey)
+	new_pub_b64 := base64.StdEncoding.EncodeToString(new_pub)
+
+	httpClient, err := newControlClient(cert_dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// ---- Phase 1: challenge ----
+	var challenge respChallenge
+	if err := postControl(ctx, httpClient, control_url, "/identity/rotate",
+		request{UserID: user_id, NewPubKey: new_pub_b64}, &challenge); err != nil {
+		return nil, err
+	}
+	nonce, err := hex.DecodeString(challenge.Nonce)
+	if err != nil || len(nonce) == 0 {
+		return nil, errors.New("server sent a malformed nonce")
+	}
+
+	// ---- Phase 2: signed by both keys ----
+	msg := signedMessage(nonce, "/identity/rotate", new_pub)
+	var result respResult
+	if err := postControl(ctx, httpClient, control_url, "/identity/rotate", request{
+		UserID:    user_id,
+		NewPubKey: new_pub_b64,
+		SigB64:    base64.StdEncoding.EncodeToString(ed25519.Sign(old_key, msg)),
+		NewSigB64: base64.StdEncoding.EncodeToString(ed25519.Sign(new_key, msg)),
+	}, &result); err != nil {
+		return nil, err
+	}
+	if !result.Rotated {
+		return nil, errors.New("server refused the new signing key")
+	}
+
+	if _, err := db.ExecContext(ctx,
+		`UPDATE signing_key_table SET sign_seed = ?, created_at = datetime('now') WHERE id = 1`, seed); err != nil {
+		return nil, fmt.Errorf("server switched keys but storing the new one failed, ask an admin to run setsigningkey: %w", err)
+	}
+	return new_pub, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"guardedim/client"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// enrollCmd redeems an invite as a new user and records the result in the config file.
+// Called like: gdim enroll --token TOKEN --username NAME [--display-name N] [--url URL] [--ca FILE] [--wait 1h]
+func enrollCmd(db *sql.DB, args []string) {
+	fs := flag.NewFlagSet("enroll", flag.ExitOnError)
+	token := fs.String("token", "", "invite token (required)")
+	username := fs.String("username", "", "username to register (required)")
+	display_name := fs.String("display-name", "", "display name (optional, defaults to the username)")
+	control_url := fs.String("url", cfg.ControlURL, "control server URL")
+	ca_file := fs.String("ca", filepath.Join(cfg.ClientCertDir, "ca.crt"), "CA certificate of the control server")
+	wait := fs.Duration("wait", time.Hour, "how long to wait for an admin to approve the enrollment")
+	fs.Parse(args)
+
+	if *token == "" || *username == "" || *control_url == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if cfg.UserID != 0 {
+		fmt.Printf("this client is already user %d\n", cfg.UserID)
+		os.Exit(1)
+	}
+
+	httpClient, err := client.NewEnrollClient(*ca_file)
+	if err != nil {
+		fmt.Printf("cannot reach the control server: %v\n", err)
+		os.Exit(1)
+	}
+	result, err := awaitEnrollment(*wait, "gdim enroll", func(ctx context.Context) (client.EnrollResult, error) {
+		return client.Enroll(ctx, db, httpClient, *control_url, cfg.ClientCertDir, *token, *username, *display_name)
+	})
+	if err != nil {
+		fmt.Printf("enrollment failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	for key, value := range map[string]any{
+		"self_client_user_id":      result.UserID,
+		"self_server_wireguard_ip": result.LatestIP.String(),
+		"control_server_url":       *control_url,
+	} {
+		if err := updateConfigField(key, value); err != nil {
+			fmt.Printf("enrolled as user %d (%s) but failed to update %s: %v\n", result.UserID, result.LatestIP, configFile, err)
+			os.Exit(1)
+		}
+	}
+	fmt.Printf("enrolled as user %d with overlay address %s, %d relays stored\n",
+		result.UserID, result.LatestIP, len(result.Relays))
+	if len(result.Certificate) != 0 && len(cfg.ClientCertDir) != 0 {
+		fmt.Printf("client certificate stored in %s\n", cfg.ClientCertDir)
+	}
+}
+
+// enrollPollInterval is how often a pending enrollment is polled
+const enrollPollInterval = 15 * time.Second
+
+// awaitEnrollment runs enroll until the enrollment is no longer waiting for approval or wait
+// has passed; rerun names the command that resumes waiting afterwards
+func awaitEnrollment(wait time.Duration, rerun string, enroll func(ctx context.Context) (client.EnrollResult, error)) (client.EnrollResult, error) {
+	deadline := time.Now().Add(wait)
+	announced := false
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		result, err := enroll(ctx)
+		cancel()
+		if !errors.Is(err, client.ErrEnrollmentPending) {
+			return result, err
+		}
+		if !announced {
+			fmt.Printf("enrollment request %d is waiting for an admin (gdim pending approve %d), polling\n",
+				result.RequestID, result.RequestID)
+			announced = true
+		}
+		if time.Now().Add(enrollPollInterval).After(deadline) {
+			return result, fmt.Errorf("%w, run %s with the same invite again to keep waiting", err, rerun)
+		}
+		time.Sleep(enrollPollInterval)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"guardedim/client"
+	"os"
+)
+
+// fetchServerInfoCmd syncs the control server's relay table into the local SQLite database.
+// Called like: gdim fetchserverinfo [--url https://10.0.12.1:8089] [--cert-dir DIR] [--json]
+func fetchServerInfoCmd(db *sql.DB, args []string) {
+	fs := flag.NewFlagSet("fetchserverinfo", flag.ExitOnError)
+	control_url := fs.String("url", cfg.ControlURL, "control server URL")
+	cert_dir := fs.String("cert-dir", cfg.ClientCertDir, "directory holding ca.crt, client.crt and client.key")
+	as_json := fs.Bool("json", false, "print the changes as JSON")
+	fs.Parse(args)
+
+	if *control_url == "" || *cert_dir == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	report, err := client.FetchServerInfo(db, *control_url, *cert_dir)
+	if err != nil {
+		fmt.Printf("failed to fetch server info: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *as_json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+		return
+	}
+	for _, r := range report.Added {
+		fmt.Printf("+ %s\n", r)
+	}
+	for _, r := range report.Changed {
+		fmt.Printf("~ %s\n", r)
+	}
+	for _, r := range report.Removed {
+		fmt.Printf("- %s\n", r)
+	}
+	fmt.Printf("%d added, %d changed, %d removed\n", len(report.Added), len(report.Changed), len(report.Removed))
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"guardedim/client"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// inviteNewUserCmd asks the control server for an invite signed on behalf of this user.
+// Called like: gdim invite [--ttl 24h]
+func inviteNewUserCmd(db *sql.DB, args []string) {
+	fs := flag.NewFlagSet("invite", flag.ExitOnError)
+	ttl := fs.Duration("ttl", 24*time.Hour, "how long the invite can be redeemed (at most a week)")
+	fs.Parse(args)
+
+	if cfg.UserID == 0 || cfg.ControlURL == "" || cfg.ClientCertDir == "" {
+		fmt.Println("invite needs self_client_user_id, control_server_url and client_cert_directory in the config")
+		os.Exit(1)
+	}
+	sign_key, err := client.LoadOrCreateSigningKey(db)
+	if err != nil {
+		fmt.Printf("failed to load signing key: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	invite, err := client.InviteNewUser(ctx, cfg.ControlURL, cfg.ClientCertDir, cfg.UserID, *ttl, sign_key)
+	if err != nil {
+		fmt.Printf("failed to create the invite: %v\n", err)
+		os.Exit(1)
+	}
+	printInviteLink(cfg.ControlURL, filepath.Join(cfg.ClientCertDir, "ca.crt"), invite.Token, invite.ExpiresAt)
+}
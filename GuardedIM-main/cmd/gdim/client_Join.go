@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"guardedim/client"
+	"guardedim/overlay"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// joinCmd onboards this machine from a single invite link: it creates the WireGuard and
+// signing keys, enrolls, stores the relay table and the client certificate, writes the
+// config file and starts gdimd.
+// It runs before any config file exists.
+// Called like: gdim join [--username NAME] [--interface wg0] [--start=false] [--wait 1h] gdim://HOST:PORT?ca=...&token=...
+func joinCmd(args []string) {
+	hostname, _ := os.Hostname()
+	fs := flag.NewFlagSet("join", flag.ExitOnError)
+	username := fs.String("username", strings.ToLower(hostname), "username to register")
+	display_name := fs.String("display-name", "", "display name (optional, defaults to the username)")
+	iface := fs.String("interface", overlay.DefaultInterface, "wireguard interface to create")
+	localdb := fs.String("localdb", "/var/lib/gdim/client.db", "path of the local SQLite database")
+	cert_dir := fs.String("cert-dir", "/etc/gdim/certs", "where to keep the control server's CA and the client certificate")
+	force := fs.Bool("force", false, "overwrite an existing "+configFile)
+	start := fs.Bool("start", true, "start gdimd once enrolled")
+	wait := fs.Duration("wait", time.Hour, "how long to wait for an admin to approve the enrollment")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || *username == "" {
+		fmt.Println("usage: gdim join [flags] gdim://HOST:PORT?ca=...&token=...")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	if _, err := os.Stat(configFile); err == nil && !*force {
+		fmt.Printf("%s already exists, this machine is set up (use --force to replace it)\n", configFile)
+		os.Exit(1)
+	}
+	link, err := client.ParseInviteLink(fs.Arg(0))
+	if err != nil {
+		fmt.Printf("invalid invite: %v\n", err)
+		os.Exit(1)
+	}
+
+	// 1) identity lives in the local database, enrollment registers its public keys
+	if err := os.MkdirAll(filepath.Dir(*localdb), 0700); err != nil {
+		fmt.Printf("cannot create %s: %v\n", filepath.Dir(*localdb), err)
+		os.Exit(1)
+	}
+	db, err := client.InitializeLocalDB(*localdb)
+	if err != nil {
+		fmt.Printf("local database access failed: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	var caPem []byte
+	result, err := awaitEnrollment(*wait, "gdim join", func(ctx context.Context) (client.EnrollResult, error) {
+		result, ca, err := client.Join(ctx, db, link, *cert_dir, *username, *display_name)
+		caPem = ca
+		return result, err
+	})
+	if err != nil {
+		fmt.Printf("enrollment failed: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("enrolled as user %d with overlay address %s, %d relays stored\n",
+		result.UserID, result.LatestIP, len(result.Relays))
+
+	// 2) the CA next to client.crt / client.key, for later requests to the control server
+	if err := os.MkdirAll(*cert_dir, 0755); err != nil {
+		fmt.Printf("cannot create %s: %v\n", *cert_dir, err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(filepath.Join(*cert_dir, "ca.crt"), caPem, 0644); err != nil {
+		fmt.Printf("cannot store the CA: %v\n", err)
+		os.Exit(1)
+	}
+	if len(result.Certificate) == 0 {
+		fmt.Printf("the control server issued no client certificate, place client.crt for %s in %s\n",
+			filepath.Join(*cert_dir, "client.key"), *cert_dir)
+	}
+
+	// 3) the config file every other command reads
+	conf := map[string]any{
+		"operation_mode":            "client",
+		"self_server_wireguard_ip":  result.LatestIP.String(),
+		"self_server_wireguard_mtu": overlay.DefaultMTU,
+		"self_client_localdb":       *localdb,
+		"self_client_user_id":       result.UserID,
+		"control_server_url":        link.ControlURL,
+		"client_cert_directory":     *cert_dir,
+		"wireguard_interface":       *iface,
+	}
+	if result.OverlaySupernet.IsValid() {
+		conf["overlay_supernet"] = result.OverlaySupernet.String()
+	}
+	if result.OverlayULA.IsValid() {
+		conf["overlay_ula_prefix"] = result.OverlayULA.String()
+	}
+	data, err := json.MarshalIndent(conf, "", "\t")
+	if err != nil {
+		fmt.Printf("cannot encode the config: %v\n", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(configFile, append(data, '\n'), 0600); err != nil {
+		fmt.Printf("cannot write %s: %v\n", configFile, err)
+		os.Exit(1)
+	}
+	fmt.Printf("wrote %s\n", configFile)
+
+	// 4) bring the overlay up
+	if !*start {
+		return
+	}
+	if err := loadConfig(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	startClientCmd(clientEnv(), nil)
+}
+
+// printInviteLink shows a token both on its own and as a link for gdim join
+func printInviteLink(control_url string, ca_file string, token string, expires time.Time) {
+	fmt.Printf("invite (single use, expires %s):\n%s\n", expires.Local().Format(time.RFC3339), token)
+	caPem, err := os.ReadFile(ca_file)
+	if err != nil {
+		fmt.Printf("no join link, cannot read the CA: %v\n", err)
+		return
+	}
+	link, err := client.NewInviteLink(control_url, caPem, token)
+	if err != nil {
+		fmt.Printf("no join link: %v\n", err)
+		return
+	}
+	fmt.Printf("\njoin with:\ngdim join '%s'\n", link)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"guardedim/client"
+	"os"
+	"time"
+)
+
+// migrateLocalCmd applies or lists the schema migrations of the client's SQLite database.
+// Called like: gdim migrate up|status
+func migrateLocalCmd(db *sql.DB, args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: gdim migrate up|status")
+	}
+	fs.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	switch fs.Arg(0) {
+	case "up":
+		done, err := client.MigrateLocalDB(ctx, db)
+		for _, m := range done {
+			fmt.Printf("applied %3d  %s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			fmt.Printf("migration failed: %v\n", err)
+			os.Exit(1)
+		}
+		if len(done) == 0 {
+			fmt.Println("schema already up to date")
+		}
+	case "status":
+		states, err := client.LocalMigrationStatus(ctx, db)
+		if err != nil {
+			fmt.Printf("failed to read migration status: %v\n", err)
+			os.Exit(1)
+		}
+		for _, m := range states {
+			printMigrationState(m.Version, m.Name, m.AppliedAt)
+		}
+	default:
+		fs.Usage()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"guardedim/client"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// replaceIPCmd moves this client to another overlay address through the signed /ip/replace flow.
+// Called like: gdim replaceip --ip 10.0.12.7 [--restart=false]
+func replaceIPCmd(db *sql.DB, args []string) {
+	fs := flag.NewFlagSet("replaceip", flag.ExitOnError)
+	ip := fs.String("ip", cfg.SelfIP, "overlay address to claim")
+	restart := fs.Bool("restart", true, "restart gdimd so its interface picks up the new address")
+	fs.Parse(args)
+
+	if *ip == "" || cfg.UserID == 0 || cfg.ControlURL == "" || cfg.ClientCertDir == "" {
+		fmt.Println("replaceip needs --ip plus self_client_user_id, control_server_url and client_cert_directory in the config")
+		os.Exit(1)
+	}
+
+	sign_key, err := client.LoadOrCreateSigningKey(db)
+	if err != nil {
+		fmt.Printf("failed to load signing key: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	claimed, err := client.ClaimOverlayIP(ctx, cfg.ControlURL, cfg.ClientCertDir, cfg.UserID, *ip, sign_key)
+	if err != nil {
+		fmt.Printf("failed to claim an overlay address: %v\n", err)
+		os.Exit(1)
+	}
+	if claimed != *ip {
+		fmt.Printf("%s is taken, got %s instead\n", *ip, claimed)
+	}
+
+	if err := updateConfigField("self_server_wireguard_ip", claimed); err != nil {
+		fmt.Printf("claimed %s but failed to update %s: %v\n", claimed, configFile, err)
+		os.Exit(1)
+	}
+	fmt.Printf("overlay address is now %s\n", claimed)
+
+	if *restart {
+		// the daemon reads its address from the environment file startclient wrote
+		cfg.SelfIP = claimed
+		if err := writeEnvFile(envFilePath(), clientEnv()); err != nil {
+			fmt.Printf("failed to update %s: %v\n", envFilePath(), err)
+			os.Exit(1)
+		}
+		service := serviceName()
+		if err := exec.Command("systemctl", "restart", service).Run(); err != nil {
+			fmt.Printf("failed to restart %s: %v\n", service, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s restarted\n", service)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"guardedim/client"
+	"os"
+	"time"
+)
+
+// rotateKeyCmd replaces this client's ed25519 signing key on the control server and locally.
+// Called like: gdim rotatekey
+func rotateKeyCmd(db *sql.DB, args []string) {
+	fs := flag.NewFlagSet("rotatekey", flag.ExitOnError)
+	fs.Parse(args)
+
+	if cfg.UserID == 0 || cfg.ControlURL == "" || cfg.ClientCertDir == "" {
+		fmt.Println("rotatekey needs self_client_user_id, control_server_url and client_cert_directory in the config")
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	new_pub, err := client.RotateSigningKey(ctx, db, cfg.ControlURL, cfg.ClientCertDir, cfg.UserID)
+	if err != nil {
+		fmt.Printf("signing key rotation failed: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("new signing public key: %s\n", base64.StdEncoding.EncodeToString(new_pub))
+}
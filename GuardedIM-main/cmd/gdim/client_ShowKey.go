@@ -0,0 +1,35 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"guardedim/client"
+	"os"
+)
+
+// showKeyCmd prints this client's WireGuard and signing public keys, creating them on first use.
+// Called like: gdim showkey
+func showKeyCmd(db *sql.DB, args []string) {
+	fs := flag.NewFlagSet("showkey", flag.ExitOnError)
+	fs.Parse(args)
+
+	key, err := client.LoadOrCreateIdentity(db, cfg.PrivateKey)
+	if err != nil {
+		fmt.Printf("failed to load identity: %v\n", err)
+		os.Exit(1)
+	}
+	sign_key, err := client.LoadOrCreateSigningKey(db)
+	if err != nil {
+		fmt.Printf("failed to load signing key: %v\n", err)
+		os.Exit(1)
+	}
+	sign_pub := base64.StdEncoding.EncodeToString(sign_key.Public().(ed25519.PublicKey))
+
+	fmt.Printf("wireguard public key: %s\n", key.PublicKey().String())
+	fmt.Printf("signing public key:   %s\n", sign_pub)
+	fmt.Fprintf(os.Stderr, "register them on a relay with: gdim adduser --username NAME --public-key %s --signing-key %s\n",
+		key.PublicKey().String(), sign_pub)
+}
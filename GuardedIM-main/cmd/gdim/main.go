@@ -4,10 +4,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"guardedim/client"
+	"guardedim/overlay"
 	"guardedim/server"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"strconv"
+	"strings"
 )
 
 const configFile = "guarded_im_config.json"
@@ -21,6 +24,29 @@ type typedConfig struct {
 	MTU           int    `json:"self_server_wireguard_mtu"`
 	PublicIP      string `json:"self_server_public_ip"`
 	LocalDB       string `json:"self_client_localdb"`
+	ControlURL    string `json:"control_server_url"`
+	ClientCertDir string `json:"client_cert_directory"`
+	UserID        uint64 `json:"self_client_user_id"`
+	AdminSock     string `json:"admin_socket_path"`
+	NonceStore    string `json:"nonce_store"`
+	// IPv4 CIDR relay subnets are allocated from, empty means 10.0.0.0/8
+	OverlaySupernet string `json:"overlay_supernet"`
+	// IPv6 ULA prefix (at most /96) for a dual-stack overlay, empty means IPv4 only
+	OverlayULA string `json:"overlay_ula_prefix"`
+	// TUN / WireGuard interface, empty means wg0; anything else also names the systemd unit gdimd-<iface>
+	Interface string `json:"wireguard_interface"`
+	// host number a relay takes in its subnet, 0 means 1 (x.x.x.1 of a /24)
+	RelayHost int `json:"relay_host_index"`
+	// host:port of the mTLS control server, empty means :8089
+	ControlListen string `json:"control_listen_address"`
+	// "open" (the default) or "approval": invite enrollments wait for gdim pending approve
+	EnrollmentMode string `json:"enrollment_mode"`
+
+	// durations such as "60s", empty means the daemon default
+	ReconcileInterval  string `json:"reconcile_interval"`
+	ChangePollInterval string `json:"change_poll_interval"`
+	// e.g. "720h", gdimd rotates the signing key on start once it is older; empty disables it
+	SigningKeyMaxAge string `json:"signing_key_max_age"`
 
 	DBHost    string `json:"database_host"`
 	DBPort    uint16 `json:"database_port"`
@@ -43,7 +69,89 @@ func loadConfig() error {
 	return nil
 }
 
+// updateConfigField rewrites a single key of the config file, leaving every other key as it is
+func updateConfigField(key string, value any) error {
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+	raw := map[string]any{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	raw[key] = value
+	data, err = json.MarshalIndent(raw, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(configFile, append(data, '\n'), 0600)
+}
+
+// overlayConfig validates the overlay settings of the config file
+func overlayConfig() overlay.Config {
+	ov, err := overlay.NewConfig(cfg.Interface, cfg.OverlaySupernet, cfg.OverlayULA, cfg.RelayHost, cfg.MTU)
+	if err != nil {
+		fmt.Printf("overlay configuration invalid: %v\n", err)
+		os.Exit(1)
+	}
+	return ov
+}
+
+// serviceName is the systemd unit of this instance: gdimd for wg0, gdimd-<iface> otherwise,
+// so several instances with different interfaces can run side by side
+func serviceName() string {
+	if len(cfg.Interface) == 0 || cfg.Interface == overlay.DefaultInterface {
+		return "gdimd"
+	}
+	return "gdimd-" + cfg.Interface
+}
+
+// envFilePath is where startserver / startclient keep this instance's daemon environment,
+// replaceip rewrites it there
+func envFilePath() string {
+	return "/etc/gdim/" + serviceName() + ".env"
+}
+
+// clientEnv is the gdimd environment of a client, built from the config file
+func clientEnv() []string {
+	return []string{
+		"GDIM_DAEMON_OPMODE=client",
+		"GDIM_WG_PRIVKEY=" + cfg.PrivateKey,
+		"GDIM_WG_PRIVIP=" + cfg.SelfIP,
+		"GDIM_WG_MTU=" + strconv.Itoa(cfg.MTU),
+		"GDIM_CLIENT_LOCALDB_FILEPATH=" + cfg.LocalDB,
+		"GDIM_CLIENT_USER_ID=" + strconv.FormatUint(cfg.UserID, 10),
+		"GDIM_CONTROL_URL=" + cfg.ControlURL,
+		"GDIM_CLIENT_CERT_DIR=" + cfg.ClientCertDir,
+		"GDIM_WG_IFACE=" + cfg.Interface,
+		"GDIM_OVERLAY_SUPERNET=" + cfg.OverlaySupernet,
+		"GDIM_OVERLAY_ULA=" + cfg.OverlayULA,
+		"GDIM_SIGNING_KEY_MAX_AGE=" + cfg.SigningKeyMaxAge,
+	}
+}
+
+// writeEnvFile stores the daemon environment where the unit's EnvironmentFile= points.
+// Unlike systemctl set-environment it is private to one instance, and it holds the
+// WireGuard key so only root can read it.
+func writeEnvFile(path string, env []string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	var b strings.Builder
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		v = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v)
+		fmt.Fprintf(&b, "%s=\"%s\"\n", k, v)
+	}
+	return os.WriteFile(path, []byte(b.String()), 0600)
+}
+
 func main() {
+	// join writes the config file, so it cannot need one
+	if len(os.Args) >= 2 && os.Args[1] == "join" {
+		joinCmd(os.Args[2:])
+		return
+	}
 	if err := loadConfig(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
@@ -57,7 +165,8 @@ func main() {
 	switch cfg.OperationMode {
 	case "server":
 		db, err := server.OpenDB(cfg.DBHost, cfg.DBPort, cfg.DBUser, cfg.DBCertDir)
-		if err != nil {
+		// serverstatus reports a broken database instead of bailing out
+		if err != nil && os.Args[1] != "serverstatus" {
 			fmt.Println("database connection failed")
 			os.Exit(1)
 		}
@@ -65,21 +174,54 @@ func main() {
 		switch os.Args[1] {
 		case "adduser":
 			addUserCmd(db, os.Args[2:])
+		case "setsigningkey":
+			setSigningKeyCmd(db, os.Args[2:])
 		case "addserver":
 			addServerCmd(db, os.Args[2:])
+		case "edituser":
+			editUserCmd(db, os.Args[2:])
+		case "invite":
+			inviteCmd(db, os.Args[2:])
+		case "removeuser":
+			removeUserCmd(db, os.Args[2:])
+		case "removeserver":
+			removeServerCmd(db, os.Args[2:])
+		case "suspenduser":
+			suspendUserCmd(db, os.Args[2:])
+		case "resumeuser":
+			resumeUserCmd(db, os.Args[2:])
+		case "pending":
+			pendingCmd(db, os.Args[2:])
+		case "acl":
+			aclCmd(db, os.Args[2:])
+		case "migrate":
+			migrateCmd(db, os.Args[2:])
 		case "startserver":
-			exec.Command("systemctl", "set-environment",
-				"GDIM_DAEMON_OPMODE="+"server",
-				"GDIM_WG_PRIVKEY="+cfg.PrivateKey,
-				"GDIM_DB_ACCESS_URL="+server.CraftDBAccessURL(cfg.DBHost, cfg.DBPort, cfg.DBUser, cfg.DBCertDir),
-				"GDIM_CERT_DIR="+cfg.DBCertDir,
-				"GDIM_WG_PRIVIP="+cfg.SelfIP,
-				"GDIM_WG_PORT="+strconv.Itoa(cfg.ListenPort),
-				"GDIM_WG_MTU="+strconv.Itoa(cfg.MTU)).Run()
-			startServerCmd(os.Args[2:])
+			overlayConfig()
+			startServerCmd([]string{
+				"GDIM_DAEMON_OPMODE=server",
+				"GDIM_WG_PRIVKEY=" + cfg.PrivateKey,
+				"GDIM_DB_ACCESS_URL=" + server.CraftDBAccessURL(cfg.DBHost, cfg.DBPort, cfg.DBUser, cfg.DBCertDir),
+				"GDIM_CERT_DIR=" + cfg.DBCertDir,
+				"GDIM_WG_PRIVIP=" + cfg.SelfIP,
+				"GDIM_WG_PORT=" + strconv.Itoa(cfg.ListenPort),
+				"GDIM_WG_MTU=" + strconv.Itoa(cfg.MTU),
+				"GDIM_ADMIN_SOCK=" + cfg.AdminSock,
+				"GDIM_NONCE_STORE=" + cfg.NonceStore,
+				"GDIM_WG_IFACE=" + cfg.Interface,
+				"GDIM_OVERLAY_SUPERNET=" + cfg.OverlaySupernet,
+				"GDIM_OVERLAY_ULA=" + cfg.OverlayULA,
+				"GDIM_RELAY_HOST=" + strconv.Itoa(cfg.RelayHost),
+				"GDIM_CONTROL_LISTEN=" + cfg.ControlListen,
+				"GDIM_ENROLLMENT_MODE=" + cfg.EnrollmentMode,
+				"GDIM_RECONCILE_INTERVAL=" + cfg.ReconcileInterval,
+				"GDIM_CHANGE_POLL_INTERVAL=" + cfg.ChangePollInterval}, os.Args[2:])
 		case "serverstatus":
+			serverStatusCmd(db, err, os.Args[2:])
 		case "stopserver":
+			stopServerCmd(os.Args[2:])
 		case "updateconn":
+			updateConnCmd(os.Args[2:])
 		default:
 			fmt.Println("unrecognized subcommand, try again")
 			os.Exit(1)
@@ -87,11 +229,65 @@ func main() {
 	case "client":
 		switch os.Args[1] {
 		case "startclient":
-			exec.Command("systemctl", "set-environment",
-				"GDIM_CLIENT_LOCALDB_FILEPATH="+cfg.LocalDB)
-			startClientCmd(os.Args[2:])
+			overlayConfig()
+			startClientCmd(clientEnv(), os.Args[2:])
 		case "fetchserverinfo":
+			db, err := client.InitializeLocalDB(cfg.LocalDB)
+			if err != nil {
+				fmt.Printf("local database access failed: %v\n", err)
+				os.Exit(1)
+			}
+			fetchServerInfoCmd(db, os.Args[2:])
+			db.Close()
+		case "showkey":
+			db, err := client.InitializeLocalDB(cfg.LocalDB)
+			if err != nil {
+				fmt.Printf("local database access failed: %v\n", err)
+				os.Exit(1)
+			}
+			showKeyCmd(db, os.Args[2:])
+			db.Close()
+		case "rotatekey":
+			db, err := client.InitializeLocalDB(cfg.LocalDB)
+			if err != nil {
+				fmt.Printf("local database access failed: %v\n", err)
+				os.Exit(1)
+			}
+			rotateKeyCmd(db, os.Args[2:])
+			db.Close()
+		case "replaceip":
+			db, err := client.InitializeLocalDB(cfg.LocalDB)
+			if err != nil {
+				fmt.Printf("local database access failed: %v\n", err)
+				os.Exit(1)
+			}
+			replaceIPCmd(db, os.Args[2:])
+			db.Close()
+		case "migrate":
+			// unlike the other commands, don't migrate on open so status shows what is pending
+			db, err := client.OpenLocalDB(cfg.LocalDB)
+			if err != nil {
+				fmt.Printf("local database access failed: %v\n", err)
+				os.Exit(1)
+			}
+			migrateLocalCmd(db, os.Args[2:])
+			db.Close()
 		case "invite":
+			db, err := client.InitializeLocalDB(cfg.LocalDB)
+			if err != nil {
+				fmt.Printf("local database access failed: %v\n", err)
+				os.Exit(1)
+			}
+			inviteNewUserCmd(db, os.Args[2:])
+			db.Close()
+		case "enroll":
+			db, err := client.InitializeLocalDB(cfg.LocalDB)
+			if err != nil {
+				fmt.Printf("local database access failed: %v\n", err)
+				os.Exit(1)
+			}
+			enrollCmd(db, os.Args[2:])
+			db.Close()
 		default:
 			fmt.Println("unsupported subcommand")
 			os.Exit(1)
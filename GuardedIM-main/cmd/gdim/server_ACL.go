@@ -0,0 +1,206 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"guardedim/server"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+const aclUsage = `usage:
+  gdim acl list
+  gdim acl add --action allow|deny --src SELECTOR --dst SELECTOR [--proto any|tcp|udp|icmp] [--port N|N-M] [--priority 100] [--description TEXT]
+  gdim acl remove RULE_ID
+  gdim acl default allow|deny
+  gdim acl group create|delete NAME
+  gdim acl group add|remove NAME USER...
+selectors: any, relays, user:NAME, group:NAME, relay:NAME|ID, an address or a CIDR
+every command but list takes --notify=false to leave the relays to their next reconciliation`
+
+// aclCmd manages the policy the relays' packet filter enforces.
+// Called like: gdim acl list|add|remove|default|group ..., see aclUsage
+func aclCmd(db *sql.DB, args []string) {
+	if len(args) == 0 {
+		fmt.Println(aclUsage)
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "list":
+		printACL(db)
+		return
+	case "add":
+		fs := flag.NewFlagSet("acl add", flag.ExitOnError)
+		action := fs.String("action", "", "allow or deny (required)")
+		src := fs.String("src", "", "source selector (required)")
+		dst := fs.String("dst", "", "destination selector (required)")
+		proto := fs.String("proto", "any", "any, tcp, udp or icmp")
+		port := fs.String("port", "", "destination port or range of tcp / udp, e.g. 22 or 8000-8100 (optional)")
+		priority := fs.Int("priority", 100, "rules with lower priority are matched first")
+		description := fs.String("description", "", "note shown by gdim acl list (optional)")
+		notify := fs.Bool("notify", true, "make running relays apply the change now")
+		fs.Parse(args[1:])
+		if *action == "" || *src == "" || *dst == "" {
+			fs.Usage()
+			os.Exit(1)
+		}
+
+		from, to, err := server.ParsePortRange(*port)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		rule_id, err := server.AddACLRule(db, server.ACLRule{
+			Priority:    *priority,
+			Action:      *action,
+			Src:         *src,
+			Dst:         *dst,
+			Protocol:    *proto,
+			PortFrom:    from,
+			PortTo:      to,
+			Description: *description,
+		})
+		if err != nil {
+			fmt.Printf("failed to add the rule: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("added rule %d\n", rule_id)
+		if *notify {
+			pushToRelays(db)
+		}
+	case "remove":
+		fs := flag.NewFlagSet("acl remove", flag.ExitOnError)
+		notify := fs.Bool("notify", true, "make running relays apply the change now")
+		fs.Parse(args[1:])
+		rule_id, err := strconv.ParseInt(fs.Arg(0), 10, 64)
+		if fs.NArg() != 1 || err != nil {
+			fmt.Println("usage: gdim acl remove RULE_ID")
+			os.Exit(1)
+		}
+
+		if err := server.RemoveACLRule(db, rule_id); err != nil {
+			fmt.Printf("failed to remove the rule: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("removed rule %d\n", rule_id)
+		if *notify {
+			pushToRelays(db)
+		}
+	case "default":
+		fs := flag.NewFlagSet("acl default", flag.ExitOnError)
+		notify := fs.Bool("notify", true, "make running relays apply the change now")
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			fmt.Println("usage: gdim acl default allow|deny")
+			os.Exit(1)
+		}
+
+		if err := server.SetACLDefault(db, fs.Arg(0)); err != nil {
+			fmt.Printf("failed to set the default: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("packets no rule matches: %s\n", fs.Arg(0))
+		if *notify {
+			pushToRelays(db)
+		}
+	case "group":
+		aclGroupCmd(db, args[1:])
+	default:
+		fmt.Println(aclUsage)
+		os.Exit(1)
+	}
+}
+
+// aclGroupCmd handles gdim acl group ...
+func aclGroupCmd(db *sql.DB, args []string) {
+	if len(args) == 0 {
+		fmt.Println(aclUsage)
+		os.Exit(1)
+	}
+	fs := flag.NewFlagSet("acl group "+args[0], flag.ExitOnError)
+	notify := fs.Bool("notify", true, "make running relays apply the change now")
+	fs.Parse(args[1:])
+	if fs.NArg() < 1 {
+		fmt.Println(aclUsage)
+		os.Exit(1)
+	}
+	name := fs.Arg(0)
+
+	var err error
+	switch args[0] {
+	case "create":
+		_, err = server.CreateACLGroup(db, name)
+	case "delete":
+		err = server.DeleteACLGroup(db, name)
+	case "add", "remove":
+		if fs.NArg() < 2 {
+			fmt.Printf("usage: gdim acl group %s NAME USER...\n", args[0])
+			os.Exit(1)
+		}
+		err = server.SetACLGroupMembers(db, name, fs.Args()[1:], args[0] == "remove")
+	default:
+		fmt.Println(aclUsage)
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Printf("failed to %s group %s: %v\n", args[0], name, err)
+		os.Exit(1)
+	}
+	fmt.Printf("group %s: %s done\n", name, args[0])
+	// an empty group changes nothing yet
+	if *notify && args[0] != "create" {
+		pushToRelays(db)
+	}
+}
+
+// printACL shows the default, the rules in matching order and the groups
+func printACL(db *sql.DB) {
+	default_action, rules, err := server.ListACLRules(db)
+	if err != nil {
+		fmt.Printf("failed to read the rules: %v\n", err)
+		os.Exit(1)
+	}
+	groups, err := server.ListACLGroups(db)
+	if err != nil {
+		fmt.Printf("failed to read the groups: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("default: %s\n\n", default_action)
+	if len(rules) == 0 {
+		fmt.Println("no rules")
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tPRIORITY\tACTION\tSOURCE\tDESTINATION\tPROTO\tPORTS\tDESCRIPTION")
+		for _, r := range rules {
+			ports := "-"
+			if r.Protocol == "tcp" || r.Protocol == "udp" {
+				ports = strconv.Itoa(r.PortFrom)
+				if r.PortFrom != r.PortTo {
+					ports += "-" + strconv.Itoa(r.PortTo)
+				}
+				if r.PortFrom == 0 && r.PortTo == 65535 {
+					ports = "all"
+				}
+			}
+			fmt.Fprintf(tw, "%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				r.RuleID, r.Priority, r.Action, r.Src, r.Dst, r.Protocol, ports, orDash(r.Description))
+		}
+		tw.Flush()
+	}
+
+	if len(groups) == 0 {
+		return
+	}
+	fmt.Println()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "GROUP\tMEMBERS")
+	for _, g := range groups {
+		fmt.Fprintf(tw, "%s\t%s\n", g.Name, orDash(strings.Join(g.Members, ",")))
+	}
+	tw.Flush()
+}
@@ -10,14 +10,15 @@ import (
 func addServerCmd(db *sql.DB, args []string) {
 	fs := flag.NewFlagSet("addserver", flag.ExitOnError)
 	server_name := fs.String("server-name", "default_name", "optional")
-	pub_ip := fs.String("public-ip", "", "public IP (required)")
+	pub_ip := fs.String("public-ip", "", "public IPv4 or IPv6 address (required)")
 	port := fs.Int("port", 51820, "wireguard listening port")
-	server_privip := fs.String("private-ip", "", "subnet IP (required)")
+	server_subnet := fs.String("subnet", "", "relay subnet as CIDR, or /N for the next free block of that size (optional, default next free /24)")
+	server_privip := fs.String("private-ip", "", "relay IP, host relay_host_index of its subnet (optional)")
 	server_pubkey := fs.String("public-key", "", "wireguard public key (required)")
 	server_presharedkey := fs.String("preshared-key", "", "wireguard preshared key (required)")
 	fs.Parse(args)
 
-	if *pub_ip == "" || *server_privip == "" || *server_pubkey == "" || *server_presharedkey == "" {
+	if *pub_ip == "" || *server_pubkey == "" || *server_presharedkey == "" {
 		fs.Usage()
 		return
 	}
@@ -28,8 +29,9 @@ func addServerCmd(db *sql.DB, args []string) {
 	}
 	server_port := (uint16(*port))
 
-	if _, err := server.AddServer(db, *server_name, *pub_ip, server_port, *server_privip, *server_pubkey, *server_presharedkey); err == nil {
-		fmt.Println("server successfully added")
+	if server_id, subnet, err := server.AddServer(db, overlayConfig(), *server_name, *pub_ip, server_port, *server_privip, *server_subnet,
+		*server_pubkey, *server_presharedkey); err == nil {
+		fmt.Printf("server successfully added, server_id %d, subnet %s\n", server_id, subnet)
 	} else {
 		fmt.Printf("error when adding server: %v\n", err)
 	}
@@ -2,27 +2,63 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
 	"guardedim/server"
+	"time"
 )
 
 func addUserCmd(db *sql.DB, args []string) {
 	fs := flag.NewFlagSet("adduser", flag.ExitOnError)
 	username := fs.String("username", "", "username (required)")
 	display_name := fs.String("display-name", "", "display name (optional)")
-	latest_ip := fs.String("latest-ip", "", "user wireguard ip address (required)")
+	latest_ip := fs.String("latest-ip", "", "user wireguard ip address (optional, allocated from the relay's subnet)")
+	relay := fs.String("relay", "", "home relay name or ID (optional when there is only one relay)")
 	pubkey := fs.String("public-key", "", "wireguard public key (required)")
+	signing_key := fs.String("signing-key", "", "ed25519 signing public key (optional)")
+	expires := fs.String("expires", "", "when the account stops working: a duration such as 720h, a date or RFC 3339 time (optional)")
 	fs.Parse(args)
 
 	if *username == "" || *pubkey == "" {
 		fs.Usage()
 		return
 	}
+	expires_at, err := parseExpiry(*expires)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 
-	if _, err := server.AddUser(db, *username, *display_name, *pubkey, *latest_ip); err == nil {
-		fmt.Println("successfully added the user")
-	} else {
+	user_id, err := server.AddUser(db, *username, *display_name, *pubkey, *signing_key, *relay, *latest_ip, expires_at)
+	if err != nil {
 		fmt.Printf("failed to add the user: %v\n", err)
+		return
+	}
+	ip, _ := server.UserOverlayIP(db, user_id)
+	fmt.Printf("successfully added the user (user_id %d, ip %s)\n", user_id, ip)
+	if !expires_at.IsZero() {
+		fmt.Printf("the account expires %s\n", expires_at.Local().Format(time.RFC3339))
+	}
+}
+
+// parseExpiry reads an --expires value: empty or "never" (the zero Time), a duration from now
+// such as "720h", a date "2006-01-02" (its start, local time) or an RFC 3339 time
+func parseExpiry(s string) (time.Time, error) {
+	if s == "" || s == "never" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		if d <= 0 {
+			return time.Time{}, errors.New("expiry must lie in the future")
+		}
+		return time.Now().Add(d).Truncate(time.Second), nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
 	}
+	return time.Time{}, fmt.Errorf("invalid expiry %q, use a duration (720h), a date (2006-01-02) or an RFC 3339 time", s)
 }
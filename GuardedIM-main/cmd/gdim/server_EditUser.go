@@ -0,0 +1,38 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"guardedim/server"
+)
+
+// editUserCmd changes a user's display name, WireGuard key, address or home relay and pushes it to the relays.
+// Called like: gdim edituser --user NAME|ID [--display-name N] [--public-key KEY] [--relay NAME|ID] [--latest-ip ADDR]
+func editUserCmd(db *sql.DB, args []string) {
+	fs := flag.NewFlagSet("edituser", flag.ExitOnError)
+	user := fs.String("user", "", "username or user_id (required)")
+	display_name := fs.String("display-name", "", "new display name (optional)")
+	pubkey := fs.String("public-key", "", "new wireguard public key (optional)")
+	relay := fs.String("relay", "", "new home relay name or ID (optional, allocates an address there)")
+	latest_ip := fs.String("latest-ip", "", "new user wireguard ip address (optional)")
+	notify := fs.Bool("notify", true, "make running relays pick the change up now")
+	fs.Parse(args)
+
+	edit := server.UserEdit{DisplayName: *display_name, PubKey: *pubkey, Relay: *relay, LatestIP: *latest_ip}
+	if *user == "" || edit == (server.UserEdit{}) {
+		fs.Usage()
+		return
+	}
+
+	user_id, err := server.EditUser(db, *user, edit)
+	if err != nil {
+		fmt.Printf("failed to edit the user: %v\n", err)
+		return
+	}
+	ip, _ := server.UserOverlayIP(db, user_id)
+	fmt.Printf("successfully edited the user (user_id %d, ip %s)\n", user_id, ip)
+	if *notify {
+		pushToRelays(db)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"guardedim/server"
+	"net"
+	"path/filepath"
+)
+
+// inviteCmd issues an admin invite token for a new client to redeem with gdim enroll.
+// Called like: gdim invite [--relay NAME|ID] [--ttl 24h] [--endpoint HOST:PORT]
+func inviteCmd(db *sql.DB, args []string) {
+	fs := flag.NewFlagSet("invite", flag.ExitOnError)
+	relay := fs.String("relay", "", "home relay of the invitee (optional when there is only one relay)")
+	ttl := fs.Duration("ttl", server.DefaultInviteTTL, "how long the invite can be redeemed")
+	_, port, _ := net.SplitHostPort(controlDialAddr(cfg.ControlListen))
+	endpoint := fs.String("endpoint", net.JoinHostPort(cfg.PublicIP, port), "control server address the invitee connects to")
+	fs.Parse(args)
+
+	invite, err := server.CreateInvite(db, *relay, *ttl)
+	if err != nil {
+		fmt.Printf("failed to create the invite: %v\n", err)
+		return
+	}
+	printInviteLink("https://"+*endpoint, filepath.Join(cfg.DBCertDir, "ca.crt"), invite.Token, invite.ExpiresAt)
+}
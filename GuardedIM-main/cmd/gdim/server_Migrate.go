@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"guardedim/server"
+	"os"
+	"time"
+)
+
+// migrateCmd applies or lists the CockroachDB schema migrations.
+// Called like: gdim migrate up|status
+func migrateCmd(db *sql.DB, args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: gdim migrate up|status")
+	}
+	fs.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	switch fs.Arg(0) {
+	case "up":
+		done, err := server.MigrateUp(ctx, db)
+		for _, m := range done {
+			fmt.Printf("applied %3d  %s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			fmt.Printf("migration failed: %v\n", err)
+			os.Exit(1)
+		}
+		if len(done) == 0 {
+			fmt.Println("schema already up to date")
+		}
+	case "status":
+		states, err := server.MigrationStatus(ctx, db)
+		if err != nil {
+			fmt.Printf("failed to read migration status: %v\n", err)
+			os.Exit(1)
+		}
+		for _, m := range states {
+			printMigrationState(m.Version, m.Name, m.AppliedAt)
+		}
+	default:
+		fs.Usage()
+		os.Exit(1)
+	}
+}
+
+// printMigrationState prints one line of `gdim migrate status`
+func printMigrationState(version int, name string, applied_at *time.Time) {
+	state := "pending"
+	if applied_at != nil {
+		state = applied_at.Local().Format(time.DateTime)
+	}
+	fmt.Printf("%3d  %-19s  %s\n", version, state, name)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"guardedim/server"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// pendingCmd manages the enrollment requests filed in approval mode.
+// Called like:
+//
+//	gdim pending list [--all]
+//	gdim pending approve [--relay NAME|ID] [--latest-ip ADDR] [--notify=false] ID|USERNAME
+//	gdim pending reject [--reason TEXT] ID|USERNAME
+func pendingCmd(db *sql.DB, args []string) {
+	if len(args) == 0 {
+		fmt.Println("usage: gdim pending list|approve|reject [flags]")
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "list":
+		fs := flag.NewFlagSet("pending list", flag.ExitOnError)
+		all := fs.Bool("all", false, "include approved and rejected requests")
+		fs.Parse(args[1:])
+
+		requests, err := server.ListEnrollments(db, *all)
+		if err != nil {
+			fmt.Printf("failed to list enrollment requests: %v\n", err)
+			os.Exit(1)
+		}
+		if len(requests) == 0 {
+			fmt.Println("no enrollment requests")
+			return
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tUSERNAME\tDISPLAY NAME\tRELAY\tINVITED BY\tREQUESTED\tSTATUS\tPUBLIC KEY")
+		for _, r := range requests {
+			status := r.Status
+			switch {
+			case r.Status == server.EnrollApproved:
+				status = fmt.Sprintf("approved (user %d)", r.UserID)
+			case r.Status == server.EnrollRejected && r.Reason != "":
+				status = "rejected: " + r.Reason
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				r.RequestID, r.Username, r.DisplayName, orDash(r.Relay), orDash(r.InvitedBy),
+				r.CreatedAt.Local().Format(time.DateTime), status, r.PubKey)
+		}
+		tw.Flush()
+	case "approve":
+		fs := flag.NewFlagSet("pending approve", flag.ExitOnError)
+		relay := fs.String("relay", "", "home relay, name or server_id (optional, defaults to the invite's)")
+		latest_ip := fs.String("latest-ip", "", "overlay address (optional, allocated when empty)")
+		notify := fs.Bool("notify", true, "make running relays add the peer now")
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(1)
+		}
+
+		user_id, err := server.ApproveEnrollment(db, fs.Arg(0), *relay, *latest_ip)
+		if err != nil {
+			fmt.Printf("failed to approve the request: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("approved, created user_id %d\n", user_id)
+		if *notify {
+			pushToRelays(db)
+		}
+	case "reject":
+		fs := flag.NewFlagSet("pending reject", flag.ExitOnError)
+		reason := fs.String("reason", "", "told to the client when it polls (optional)")
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(1)
+		}
+
+		request_id, err := server.RejectEnrollment(db, fs.Arg(0), *reason)
+		if err != nil {
+			fmt.Printf("failed to reject the request: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("rejected request %d\n", request_id)
+	default:
+		fmt.Println("usage: gdim pending list|approve|reject [flags]")
+		os.Exit(1)
+	}
+}
+
+// orDash keeps empty table cells visible
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
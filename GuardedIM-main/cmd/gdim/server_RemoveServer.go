@@ -0,0 +1,34 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"guardedim/server"
+)
+
+// removeServerCmd deletes (or tombstones) a relay, the other relays drop it as a peer
+// and the removed relay, if it is still running, drops all of its peers.
+// Called like: gdim removeserver --relay NAME|ID [--keep-history] [--notify=false]
+func removeServerCmd(db *sql.DB, args []string) {
+	fs := flag.NewFlagSet("removeserver", flag.ExitOnError)
+	relay := fs.String("relay", "", "relay name or server_id (required)")
+	keep_history := fs.Bool("keep-history", false, "keep the row as a tombstone, its subnet stays reserved")
+	notify := fs.Bool("notify", true, "make running relays update their peers now")
+	fs.Parse(args)
+
+	if *relay == "" {
+		fs.Usage()
+		return
+	}
+
+	removed, err := server.RemoveServer(db, *relay, *keep_history)
+	if err != nil {
+		fmt.Printf("failed to remove the server: %v\n", err)
+		return
+	}
+	fmt.Printf("successfully removed the server (server_id %d)\n", removed.ServerID)
+	if *notify {
+		pushToRelays(db, removed)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"guardedim/server"
+)
+
+// removeUserCmd deletes (or tombstones) a user and makes every relay drop its peer right away.
+// Called like: gdim removeuser --user NAME|ID [--keep-history] [--notify=false]
+func removeUserCmd(db *sql.DB, args []string) {
+	fs := flag.NewFlagSet("removeuser", flag.ExitOnError)
+	user := fs.String("user", "", "username or user_id (required)")
+	keep_history := fs.Bool("keep-history", false, "keep the row as a tombstone instead of deleting it")
+	notify := fs.Bool("notify", true, "make running relays drop the peer now")
+	fs.Parse(args)
+
+	if *user == "" {
+		fs.Usage()
+		return
+	}
+
+	user_id, err := server.RemoveUser(db, *user, *keep_history)
+	if err != nil {
+		fmt.Printf("failed to remove the user: %v\n", err)
+		return
+	}
+	fmt.Printf("successfully removed the user (user_id %d)\n", user_id)
+	if *notify {
+		pushToRelays(db)
+	}
+}
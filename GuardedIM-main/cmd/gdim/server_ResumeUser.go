@@ -0,0 +1,51 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"guardedim/server"
+	"time"
+)
+
+// resumeUserCmd lifts a suspension, optionally with a new expiry, and pushes the peer back to the relays.
+// Called like: gdim resumeuser --user NAME|ID [--expires 720h|2006-01-02|never] [--notify=false]
+func resumeUserCmd(db *sql.DB, args []string) {
+	fs := flag.NewFlagSet("resumeuser", flag.ExitOnError)
+	user := fs.String("user", "", "username or user_id (required)")
+	expires := fs.String("expires", "", "new expiry: a duration such as 720h, a date, an RFC 3339 time or never (optional)")
+	notify := fs.Bool("notify", true, "make running relays add the peer now")
+	fs.Parse(args)
+
+	if *user == "" {
+		fs.Usage()
+		return
+	}
+
+	// nil keeps the current expiry
+	var expires_at *time.Time
+	if *expires != "" {
+		t, err := parseExpiry(*expires)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		expires_at = &t
+	}
+	user_id, err := server.ResumeUser(db, *user, expires_at)
+	if err != nil {
+		fmt.Printf("failed to resume the user: %v\n", err)
+		return
+	}
+	fmt.Printf("successfully resumed the user (user_id %d)\n", user_id)
+	if _, expires_at, err := server.UserAccess(db, user_id); err == nil && !expires_at.IsZero() {
+		if expires_at.After(time.Now()) {
+			fmt.Printf("the account expires %s\n", expires_at.Local().Format(time.RFC3339))
+		} else {
+			fmt.Printf("but the account expired %s, give a new --expires\n", expires_at.Local().Format(time.RFC3339))
+		}
+	}
+	if *notify {
+		pushToRelays(db)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"guardedim/server"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// serverStatusCmd reports the health of the daemon, its interface, the database and the control server.
+// Called like: gdim serverstatus [--json]
+func serverStatusCmd(db *sql.DB, db_err error, args []string) {
+	fs := flag.NewFlagSet("serverstatus", flag.ExitOnError)
+	as_json := fs.Bool("json", false, "print the status as JSON")
+	control_addr := fs.String("control-addr", controlDialAddr(cfg.ControlListen), "address of the mTLS control server")
+	fs.Parse(args)
+	service := serviceName()
+
+	var status server.ServerStatus
+
+	// 1) daemon
+	out, err := exec.Command("systemctl", "is-active", service).Output()
+	state := strings.TrimSpace(string(out))
+	if state == "" && err != nil {
+		state = err.Error()
+	}
+	status.Daemon = server.ComponentStatus{OK: err == nil && state == "active", Detail: service + " " + state}
+
+	// 2) wireguard
+	peers, err := server.WireGuardStatus(overlayConfig().Interface)
+	if err != nil {
+		status.WireGuard = server.ComponentStatus{Detail: err.Error()}
+	} else {
+		status.WireGuard = server.ComponentStatus{OK: true, Detail: fmt.Sprintf("%d peers", len(peers))}
+		status.Peers = peers
+	}
+
+	// 3) database
+	if db_err != nil {
+		status.Database = server.ComponentStatus{Detail: db_err.Error()}
+	} else if rtt, err := server.DBStatus(db); err != nil {
+		status.Database = server.ComponentStatus{Detail: err.Error()}
+	} else {
+		status.Database = server.ComponentStatus{OK: true, Detail: fmt.Sprintf("ping %s", rtt.Round(time.Millisecond))}
+	}
+
+	// 4) control server
+	if err := server.ControlServStatus(*control_addr, cfg.DBCertDir); err != nil {
+		status.ControlServ = server.ComponentStatus{Detail: err.Error()}
+	} else {
+		status.ControlServ = server.ComponentStatus{OK: true, Detail: "serving on " + *control_addr}
+	}
+
+	if *as_json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(status)
+	} else {
+		printServerStatus(status)
+	}
+
+	if !status.Daemon.OK || !status.WireGuard.OK || !status.Database.OK || !status.ControlServ.OK {
+		os.Exit(1)
+	}
+}
+
+// controlDialAddr turns the control server's listen address into one to dial from this host
+func controlDialAddr(listen string) string {
+	if len(listen) == 0 {
+		listen = server.DefaultControlListen
+	}
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return listen
+	}
+	if len(host) == 0 || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// printServerStatus renders the status as human readable tables
+func printServerStatus(status server.ServerStatus) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "COMPONENT\tSTATE\tDETAIL")
+	for _, c := range []struct {
+		name string
+		st   server.ComponentStatus
+	}{
+		{"gdimd", status.Daemon},
+		{"wireguard", status.WireGuard},
+		{"database", status.Database},
+		{"control server", status.ControlServ},
+	} {
+		state := "DOWN"
+		if c.st.OK {
+			state = "OK"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", c.name, state, c.st.Detail)
+	}
+	tw.Flush()
+
+	if len(status.Peers) == 0 {
+		return
+	}
+	fmt.Println()
+	tw = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PEER\tENDPOINT\tALLOWED IPS\tHANDSHAKE\tRX\tTX")
+	for _, p := range status.Peers {
+		handshake := "never"
+		if p.HandshakeAge >= 0 {
+			handshake = (time.Duration(p.HandshakeAge) * time.Second).String() + " ago"
+		}
+		endpoint := p.Endpoint
+		if endpoint == "" {
+			endpoint = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\n",
+			p.PublicKey, endpoint, strings.Join(p.AllowedIPs, ","), handshake, p.RxBytes, p.TxBytes)
+	}
+	tw.Flush()
+}
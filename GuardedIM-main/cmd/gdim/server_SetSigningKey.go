@@ -0,0 +1,28 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"guardedim/server"
+)
+
+// setSigningKeyCmd registers or replaces a user's ed25519 signing key.
+// Called like: gdim setsigningkey --username alice --signing-key BASE64
+func setSigningKeyCmd(db *sql.DB, args []string) {
+	fs := flag.NewFlagSet("setsigningkey", flag.ExitOnError)
+	username := fs.String("username", "", "username (required)")
+	signing_key := fs.String("signing-key", "", "ed25519 signing public key (required)")
+	fs.Parse(args)
+
+	if *username == "" || *signing_key == "" {
+		fs.Usage()
+		return
+	}
+
+	if err := server.SetUserSigningKey(db, *username, *signing_key); err == nil {
+		fmt.Println("signing key registered")
+	} else {
+		fmt.Printf("failed to register the signing key: %v\n", err)
+	}
+}
@@ -9,40 +9,47 @@ import (
 	"text/template"
 )
 
-// startServerCmd ensures gdimd.service exists, reloads systemd, enables & starts it.
+// startServerCmd writes the environment file and unit of this instance, reloads systemd, enables & starts it.
+// The unit is gdimd.service, or gdimd-<iface>.service when wireguard_interface is not wg0.
 // Called like: gdim startserver
-func startServerCmd(args []string) {
+func startServerCmd(env []string, args []string) {
+	service := serviceName()
 	fs := flag.NewFlagSet("startserver", flag.ExitOnError)
-	servicePath := fs.String("unit-path", "/etc/systemd/system/gdimd.service",
+	servicePath := fs.String("unit-path", "/etc/systemd/system/"+service+".service",
 		"location for generated systemd unit")
 	binaryPath := fs.String("bin", "/usr/local/bin/gdimd", "path to daemon binary")
 	fs.Parse(args)
+	env_path := envFilePath()
 
-	// 1) If the unit file doesn't exist, create it from template
-	if _, err := os.Stat(*servicePath); os.IsNotExist(err) {
-		if err := writeUnitFile(*servicePath, *binaryPath); err != nil {
-			fmt.Printf("cannot write unit file: %v\n", err)
-			return
-		}
-		// reload systemd to pick up the new unit
-		exec.Command("systemctl", "daemon-reload").Run()
-		exec.Command("systemctl", "enable", "gdimd").Run()
-		fmt.Println("installed and started gdimd.service")
+	// 1) the environment goes to a file of its own, so instances don't see each other's
+	if err := writeEnvFile(env_path, env); err != nil {
+		fmt.Printf("cannot write environment file: %v\n", err)
+		return
 	}
-	// 2) (re)start the service
-	if err := exec.Command("systemctl", "restart", "gdimd").Run(); err != nil {
-		fmt.Printf("failed to start gdimd: %v\n", err)
-		fmt.Println("gdimd started")
+	// 2) (re)write the unit, units from older releases lack EnvironmentFile=
+	if err := writeUnitFile(*servicePath, *binaryPath, env_path); err != nil {
+		fmt.Printf("cannot write unit file: %v\n", err)
+		return
 	}
+	// reload systemd to pick up the unit
+	exec.Command("systemctl", "daemon-reload").Run()
+	exec.Command("systemctl", "enable", service).Run()
+	// 3) (re)start the service
+	if err := exec.Command("systemctl", "restart", service).Run(); err != nil {
+		fmt.Printf("failed to start %s: %v\n", service, err)
+		return
+	}
+	fmt.Printf("%s started\n", service)
 }
 
 // writeUnitFile renders a minimal systemd unit.
-func writeUnitFile(path, bin string) error {
+func writeUnitFile(path, bin, env_path string) error {
 	const tmpl = `[Unit]
 Description=GuardedIM Daemon
 After=network-online.target
 
 [Service]
+EnvironmentFile={{ .Env }}
 ExecStart={{ .Bin }}
 Restart=on-failure
 Type=simple
@@ -55,5 +62,5 @@ WantedBy=multi-user.target
 		return err
 	}
 	defer f.Close()
-	return template.Must(template.New("unit").Parse(tmpl)).Execute(f, struct{ Bin string }{bin})
+	return template.Must(template.New("unit").Parse(tmpl)).Execute(f, struct{ Bin, Env string }{bin, env_path})
 }
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"guardedim/server"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// stopServerCmd stops this instance's gdimd through systemd and confirms its interface, address and routes are gone.
+// Called like: gdim stopserver [--timeout 10s] [--force]
+func stopServerCmd(args []string) {
+	fs := flag.NewFlagSet("stopserver", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 10*time.Second, "how long to wait for the daemon to clean up")
+	force := fs.Bool("force", false, "remove leftovers ourselves if the daemon did not")
+	fs.Parse(args)
+	ov := overlayConfig()
+	service := serviceName()
+
+	// 1) SIGTERM through systemd, gdimd closes its interface and tears it down on the way out
+	if err := exec.Command("systemctl", "stop", service).Run(); err != nil {
+		fmt.Printf("failed to stop %s: %v\n", service, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s stopped\n", service)
+
+	// 2) wait for the interface to disappear
+	deadline := time.Now().Add(*timeout)
+	for {
+		residue, err := server.WG0Residue(ov, cfg.SelfIP)
+		if err != nil {
+			fmt.Printf("cannot inspect %s: %v\n", ov.Interface, err)
+			os.Exit(1)
+		}
+		if len(residue) == 0 {
+			fmt.Printf("%s, its address and its routes are gone\n", ov.Interface)
+			return
+		}
+		if time.Now().After(deadline) {
+			fmt.Printf("still present: %s\n", strings.Join(residue, ", "))
+			break
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+
+	// 3) clean up after a daemon that crashed or hung
+	if !*force {
+		fmt.Println("run gdim stopserver --force to remove them")
+		os.Exit(1)
+	}
+	if err := server.TeardownWG0Linux(ov, cfg.SelfIP); err != nil {
+		fmt.Printf("teardown failed: %v\n", err)
+		os.Exit(1)
+	}
+	if residue, err := server.WG0Residue(ov, cfg.SelfIP); err != nil || len(residue) != 0 {
+		fmt.Printf("teardown incomplete: %s %v\n", strings.Join(residue, ", "), err)
+		os.Exit(1)
+	}
+	fmt.Printf("removed leftover %s state\n", ov.Interface)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"guardedim/server"
+)
+
+// suspendUserCmd blocks a user without removing it and makes every relay drop its peer right away.
+// Called like: gdim suspenduser --user NAME|ID [--notify=false]
+func suspendUserCmd(db *sql.DB, args []string) {
+	fs := flag.NewFlagSet("suspenduser", flag.ExitOnError)
+	user := fs.String("user", "", "username or user_id (required)")
+	notify := fs.Bool("notify", true, "make running relays drop the peer now")
+	fs.Parse(args)
+
+	if *user == "" {
+		fs.Usage()
+		return
+	}
+
+	user_id, err := server.SuspendUser(db, *user)
+	if err != nil {
+		fmt.Printf("failed to suspend the user: %v\n", err)
+		return
+	}
+	fmt.Printf("successfully suspended the user (user_id %d)\n", user_id)
+	if *notify {
+		pushToRelays(db)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"guardedim/server"
+	"net"
+	"os"
+	"strconv"
+)
+
+// updateConnCmd asks the running gdimd to reconcile its peers right away.
+// Called like: gdim updateconn [--json]
+func updateConnCmd(args []string) {
+	fs := flag.NewFlagSet("updateconn", flag.ExitOnError)
+	as_json := fs.Bool("json", false, "print the changes as JSON")
+	fs.Parse(args)
+
+	var changes server.PeerChanges
+	if err := server.AdminRequest(server.AdminSocketPath(cfg.AdminSock, cfg.Interface), "/updateconn", &changes); err != nil {
+		fmt.Printf("peer reconciliation failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *as_json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(changes)
+		return
+	}
+	printPeerChanges(changes)
+}
+
+// printPeerChanges lists every touched peer with a +, ~ or - marker
+func printPeerChanges(changes server.PeerChanges) {
+	if len(changes.Added)+len(changes.Changed)+len(changes.Removed) == 0 {
+		fmt.Println("peers already up to date")
+		return
+	}
+	for _, k := range changes.Added {
+		fmt.Printf("+ %s\n", k)
+	}
+	for _, k := range changes.Changed {
+		fmt.Printf("~ %s\n", k)
+	}
+	for _, k := range changes.Removed {
+		fmt.Printf("- %s\n", k)
+	}
+	fmt.Printf("%d added, %d changed, %d removed\n", len(changes.Added), len(changes.Changed), len(changes.Removed))
+}
+
+// pushToRelays makes every running relay (and the extra ones) reconcile now and reports each answer.
+// Relays are reached on the control server port of this relay's control_listen_address.
+func pushToRelays(db *sql.DB, extra ...server.RelayTarget) {
+	_, port, err := net.SplitHostPort(controlDialAddr(cfg.ControlListen))
+	if err != nil {
+		fmt.Printf("invalid control_listen_address: %v\n", err)
+		return
+	}
+	notices, err := server.NotifyRelays(db, cfg.DBCertDir, port, extra...)
+	if err != nil {
+		fmt.Printf("cannot notify relays: %v\n", err)
+		return
+	}
+	for _, n := range notices {
+		name := n.Relay.Name
+		if name == "" {
+			name = strconv.FormatInt(n.Relay.ServerID, 10)
+		}
+		if n.Error != "" {
+			fmt.Printf("relay %s not notified, it catches up on its next reconciliation: %s\n", name, n.Error)
+			continue
+		}
+		fmt.Printf("relay %s (%s): %d added, %d changed, %d removed\n", name, n.Addr,
+			len(n.Changes.Added), len(n.Changes.Changed), len(n.Changes.Removed))
+	}
+}
@@ -4,12 +4,14 @@ import (
 	"context"
 	"fmt"
 	"guardedim/client"
+	"guardedim/overlay"
 	"guardedim/server"
 	"log"
 	"os"
 	"os/signal"
 	"strconv"
 	"syscall"
+	"time"
 
 	"golang.org/x/sync/errgroup"
 )
@@ -23,32 +25,104 @@ func main() {
 	wg_privip := os.Getenv("GDIM_WG_PRIVIP")
 	wg_port := os.Getenv("GDIM_WG_PORT")
 	client_localdb_path := os.Getenv("GDIM_CLIENT_LOCALDB_FILEPATH")
+	admin_sock := os.Getenv("GDIM_ADMIN_SOCK")
+	nonce_store := os.Getenv("GDIM_NONCE_STORE")
+	control_url := os.Getenv("GDIM_CONTROL_URL")
+	client_cert_dir := os.Getenv("GDIM_CLIENT_CERT_DIR")
+	client_user_id, _ := strconv.ParseUint(os.Getenv("GDIM_CLIENT_USER_ID"), 10, 64)
+	signing_key_max_age, _ := time.ParseDuration(os.Getenv("GDIM_SIGNING_KEY_MAX_AGE"))
+	// unset or unparsable intervals fall back to the server package defaults
+	reconcile_interval, _ := time.ParseDuration(os.Getenv("GDIM_RECONCILE_INTERVAL"))
+	change_poll_interval, _ := time.ParseDuration(os.Getenv("GDIM_CHANGE_POLL_INTERVAL"))
+	control_listen := os.Getenv("GDIM_CONTROL_LISTEN")
+	enrollment_mode := os.Getenv("GDIM_ENROLLMENT_MODE")
 	wg_MTU, err := strconv.Atoi(os.Getenv("GDIM_WG_MTU"))
 	if err != nil {
 		fmt.Printf("the given MTU is invalid: %v", err)
 		os.Exit(1)
 	}
+	relay_host, _ := strconv.Atoi(os.Getenv("GDIM_RELAY_HOST"))
+	// unset values take the overlay package defaults (wg0, 10.0.0.0/8, IPv4 only)
+	ov, err := overlay.NewConfig(os.Getenv("GDIM_WG_IFACE"), os.Getenv("GDIM_OVERLAY_SUPERNET"),
+		os.Getenv("GDIM_OVERLAY_ULA"), relay_host, wg_MTU)
+	if err != nil {
+		fmt.Printf("the overlay configuration is invalid: %v", err)
+		os.Exit(1)
+	}
 
 	switch opmode {
 	case "client":
-		_, err := client.InitializeLocalDB(client_localdb_path)
+		localdb, err := client.InitializeLocalDB(client_localdb_path)
 		if err != nil {
 			fmt.Printf("database access failed: %v", err)
+			os.Exit(1)
 		}
+		defer localdb.Close()
 		ctx, cancel := signal.NotifyContext(context.Background(),
 			syscall.SIGINT, syscall.SIGTERM)
 		defer cancel()
 
 		g, ctx := errgroup.WithContext(ctx)
+		// the configured key only seeds the identity on first start, afterwards the stored one wins
+		identity, err := client.LoadOrCreateIdentity(localdb, privkey)
+		if err != nil {
+			fmt.Printf("client identity unavailable: %v", err)
+			os.Exit(1)
+		}
+		log.Printf("client public key: %s", identity.PublicKey().String())
+
+		// make sure the control server records us at the address we are about to bring up
+		if control_url != "" && client_user_id != 0 {
+			sign_key, err := client.LoadOrCreateSigningKey(localdb)
+			if err != nil {
+				fmt.Printf("client signing key unavailable: %v", err)
+				os.Exit(1)
+			}
+			// rotate the signing key on its own schedule, independent of the WireGuard key
+			if age, err := client.SigningKeyAge(localdb); err == nil && signing_key_max_age > 0 && age > signing_key_max_age {
+				rotateCtx, rotateCancel := context.WithTimeout(context.Background(), 30*time.Second)
+				if _, err := client.RotateSigningKey(rotateCtx, localdb, control_url, client_cert_dir, client_user_id); err != nil {
+					log.Printf("signing key rotation failed: %v", err)
+				} else if sign_key, err = client.LoadOrCreateSigningKey(localdb); err != nil {
+					fmt.Printf("client signing key unavailable: %v", err)
+					os.Exit(1)
+				}
+				rotateCancel()
+			}
+			claimCtx, claimCancel := context.WithTimeout(context.Background(), time.Minute)
+			claimed, err := client.ClaimOverlayIP(claimCtx, control_url, client_cert_dir, client_user_id, wg_privip, sign_key)
+			claimCancel()
+			if err != nil {
+				log.Printf("overlay address claim failed, keeping %s: %v", wg_privip, err)
+			} else if claimed != wg_privip {
+				log.Printf("overlay address %s is taken, using %s", wg_privip, claimed)
+				wg_privip = claimed
+			}
+		}
+
 		g.Go(func() error {
-			wgDev, err := client.InitializeInterface(wg_privip, wg_privip, wg_MTU)
+			wgDev, err := client.InitializeInterface(ov, wg_privip, identity.String())
 			if err != nil {
 				fmt.Printf("wireguard interface initialization failed: %v", err)
 				return err
 			}
-			<-ctx.Done()
-			wgDev.Close()
-			return nil
+			defer wgDev.Close()
+
+			// join the overlay, then keep following the local relay table (gdim fetchserverinfo)
+			ticker := time.NewTicker(time.Minute)
+			defer ticker.Stop()
+			for {
+				if n, err := client.ConfigureServerPeers(localdb, ov, wg_privip); err != nil {
+					log.Printf("relay peer configuration failed: %v", err)
+				} else if n == 0 {
+					log.Println("no relays in the local server_info_table, run gdim fetchserverinfo")
+				}
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-ticker.C:
+				}
+			}
 		})
 
 		// ---------- wait & exit ----------
@@ -61,6 +135,20 @@ func main() {
 		if err != nil {
 			fmt.Printf("database access failed: %v", err)
 		}
+		// refuse to run against a schema older than this build expects
+		if db != nil {
+			checkCtx, checkCancel := context.WithTimeout(context.Background(), 10*time.Second)
+			pending, err := server.PendingMigrations(checkCtx, db)
+			checkCancel()
+			if err != nil {
+				fmt.Printf("schema version check failed: %v", err)
+				os.Exit(1)
+			}
+			if len(pending) > 0 {
+				fmt.Printf("database schema is %d migration(s) behind, run gdim migrate up", len(pending))
+				os.Exit(1)
+			}
+		}
 		// ---------- shared context ----------
 		ctx, cancel := signal.NotifyContext(context.Background(),
 			syscall.SIGINT, syscall.SIGTERM)
@@ -70,20 +158,36 @@ func main() {
 
 		// ---------- WireGuard ----------
 		g.Go(func() error {
-			wgDev, err := server.InitializeInterface(wg_privip, privkey, wg_port, wg_MTU, db_access_url)
+			wgDev, err := server.InitializeInterface(ov, wg_privip, privkey, wg_port, db_access_url)
 			if err != nil {
 				fmt.Printf("wireguard interface initialization failed: %v", err)
+				server.TeardownWG0Linux(ov, wg_privip)
 				return err
 			}
 			<-ctx.Done()
 			wgDev.Close()
+			// closing the TUN normally drops the link, make sure nothing is left for the next start
+			if err := server.TeardownWG0Linux(ov, wg_privip); err != nil {
+				log.Printf("%s teardown failed: %v", ov.Interface, err)
+			}
 			return nil
 		})
 
 		// ---------- HTTP control (mTLS) ----------
 		g.Go(func() error {
 			// certDir points to ca.crt / node.crt / node.key
-			return server.InitializeControlServ(ctx, db, cert_dir)
+			return server.InitializeControlServ(ctx, db, cert_dir, nonce_store, control_listen, ov, enrollment_mode)
+		})
+
+		// ---------- peer reconciliation ----------
+		g.Go(func() error {
+			return server.RunReconciler(ctx, db, reconcile_interval, change_poll_interval, ov)
+		})
+
+		// ---------- local admin socket ----------
+		g.Go(func() error {
+			// gdim updateconn and friends talk to the daemon through here
+			return server.InitializeAdminSocket(ctx, db, admin_sock, ov)
 		})
 
 		// ---------- wait & exit ----------
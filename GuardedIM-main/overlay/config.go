@@ -0,0 +1,114 @@
+package overlay
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"regexp"
+)
+
+// DefaultInterface is the TUN / WireGuard interface gdimd creates unless configured otherwise
+const DefaultInterface = "wg0"
+
+// DefaultSupernet is the IPv4 overlay relay subnets are carved from unless configured otherwise
+const DefaultSupernet = "10.0.0.0/8"
+
+// DefaultRelayHost is the host number a relay takes inside its own subnet, 1 is network+1 (x.x.x.1 for a /24)
+const DefaultRelayHost = 1
+
+// DefaultMTU is the TUN MTU when none is configured
+const DefaultMTU = 1500
+
+// Config is what relays and clients need to agree on to share an overlay,
+// plus the name of the local interface carrying it.
+// Two gdimd instances on one host need distinct interfaces and non-overlapping supernets.
+type Config struct {
+	Interface string       // TUN / WireGuard interface name
+	Supernet  netip.Prefix // IPv4 overlay, routed into Interface
+	ULA       netip.Prefix // IPv6 counterpart of Supernet, the zero Prefix for an IPv4-only overlay
+	RelayHost int          // host number a relay takes inside its subnet
+	MTU       int
+}
+
+// interface names the kernel accepts, and that are safe in systemd unit and socket names
+var ifaceName = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,15}$`)
+
+// NewConfig validates the overlay settings of guarded_im_config.json, empty and zero values take the defaults
+func NewConfig(iface string, supernet string, ula string, relay_host int, mtu int) (Config, error) {
+	var c Config
+	var err error
+
+	c.Interface = iface
+	if len(c.Interface) == 0 {
+		c.Interface = DefaultInterface
+	}
+	if !ifaceName.MatchString(c.Interface) || c.Interface == "." || c.Interface == ".." {
+		return c, fmt.Errorf("invalid interface name %q", c.Interface)
+	}
+
+	if len(supernet) == 0 {
+		supernet = DefaultSupernet
+	}
+	if c.Supernet, err = netip.ParsePrefix(supernet); err != nil || !c.Supernet.Addr().Is4() {
+		return c, fmt.Errorf("invalid overlay supernet %q", supernet)
+	}
+	c.Supernet = c.Supernet.Masked()
+
+	if c.ULA, err = ParseULA(ula); err != nil {
+		return c, err
+	}
+
+	c.RelayHost = relay_host
+	if c.RelayHost == 0 {
+		c.RelayHost = DefaultRelayHost
+	}
+	if c.RelayHost < 1 {
+		return c, errors.New("relay host number must be positive")
+	}
+
+	c.MTU = mtu
+	if c.MTU == 0 {
+		c.MTU = DefaultMTU
+	}
+	if c.MTU < 800 || c.MTU > 1700 {
+		return c, errors.New("the MTU is either too large or too small")
+	}
+	return c, nil
+}
+
+// Routes are the prefixes routed into the interface: the supernet and, when set, the ULA prefix
+func (c Config) Routes() []netip.Prefix {
+	routes := []netip.Prefix{c.Supernet}
+	if c.ULA.IsValid() {
+		routes = append(routes, c.ULA)
+	}
+	return routes
+}
+
+// RelayAddr returns the address a relay owning subnet takes, host RelayHost of the subnet.
+// The zero Addr means the subnet is too small for it.
+func (c Config) RelayAddr(subnet netip.Prefix) netip.Addr {
+	if !subnet.Addr().Is4() {
+		return netip.Addr{}
+	}
+	// neither the network nor the broadcast address
+	size := uint64(1) << (32 - subnet.Bits())
+	if c.RelayHost < 1 || uint64(c.RelayHost) >= size-1 {
+		return netip.Addr{}
+	}
+	b := subnet.Masked().Addr().As4()
+	binary.BigEndian.PutUint32(b[:], binary.BigEndian.Uint32(b[:])+uint32(c.RelayHost))
+	return netip.AddrFrom4(b)
+}
+
+// DualStack returns the host prefixes of an overlay address under this config
+func (c Config) DualStack(v4 netip.Addr) []netip.Prefix {
+	return DualStack(c.ULA, v4)
+}
+
+// RouteIPNets is Routes in the net.IPNet form netlink wants
+func (c Config) RouteIPNets() []net.IPNet {
+	return IPNets(c.Routes()...)
+}
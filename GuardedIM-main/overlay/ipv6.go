@@ -0,0 +1,60 @@
+// Package overlay holds the addressing rules relays and clients have to agree on.
+package overlay
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// ula is fc00::/7, the unique local address range
+var ula = netip.MustParsePrefix("fc00::/7")
+
+// ParseULA parses the configured IPv6 ULA prefix of the overlay.
+// Empty means the overlay is IPv4 only and returns the zero Prefix.
+// The prefix must leave at least 32 bits for the embedded IPv4 address.
+func ParseULA(prefix string) (netip.Prefix, error) {
+	if len(prefix) == 0 {
+		return netip.Prefix{}, nil
+	}
+	p, err := netip.ParsePrefix(prefix)
+	if err != nil || !p.Addr().Is6() || p.Addr().Is4In6() || !ula.Contains(p.Addr()) {
+		return netip.Prefix{}, fmt.Errorf("invalid overlay ULA prefix %q", prefix)
+	}
+	if p.Bits() > 96 {
+		return netip.Prefix{}, fmt.Errorf("overlay ULA prefix %q is longer than /96", prefix)
+	}
+	return p.Masked(), nil
+}
+
+// Embed6 maps an IPv4 overlay address into the ULA, the low 32 bits carry the IPv4 address:
+// with fd67:6469:6d00::/48, 10.0.12.5 becomes fd67:6469:6d00::a00:c05
+func Embed6(ula netip.Prefix, v4 netip.Addr) netip.Addr {
+	b := ula.Masked().Addr().As16()
+	v := v4.Unmap().As4()
+	copy(b[12:], v[:])
+	return netip.AddrFrom16(b)
+}
+
+// EmbedPrefix6 maps an IPv4 subnet into the ULA the same way, a /24 becomes a /120
+func EmbedPrefix6(ula netip.Prefix, v4 netip.Prefix) netip.Prefix {
+	return netip.PrefixFrom(Embed6(ula, v4.Masked().Addr()), 96+v4.Bits())
+}
+
+// DualStack returns the host prefixes of an overlay address: its /32 and, with a ULA, its /128
+func DualStack(ula netip.Prefix, v4 netip.Addr) []netip.Prefix {
+	prefixes := []netip.Prefix{netip.PrefixFrom(v4.Unmap(), 32)}
+	if ula.IsValid() {
+		prefixes = append(prefixes, netip.PrefixFrom(Embed6(ula, v4), 128))
+	}
+	return prefixes
+}
+
+// IPNets converts prefixes to the net.IPNet form wgctrl and netlink want
+func IPNets(prefixes ...netip.Prefix) []net.IPNet {
+	nets := make([]net.IPNet, 0, len(prefixes))
+	for _, p := range prefixes {
+		nets = append(nets, net.IPNet{IP: p.Addr().AsSlice(), Mask: net.CIDRMask(p.Bits(), p.Addr().BitLen())})
+	}
+	return nets
+}
@@ -0,0 +1,579 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"guardedim/overlay"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// rule actions, also the default action for packets no rule matches
+const (
+	ACLAllow = "allow"
+	ACLDeny  = "deny"
+)
+
+// ACLRule is a row of acl_rule_table.
+// Src and Dst are selectors:
+//   - any                every overlay address
+//   - user:NAME          the addresses of a user
+//   - group:NAME         the addresses of every member of a group
+//   - relay:NAME|ID      the addresses of a relay itself
+//   - relays             the addresses of every relay
+//   - an address or CIDR, e.g. 10.0.12.0/24 (IPv4 ones cover their ULA counterpart too)
+//
+// Protocol is any, tcp, udp or icmp; PortFrom-PortTo is the destination port range of tcp and udp.
+type ACLRule struct {
+	RuleID      int64
+	Priority    int
+	Action      string
+	Src         string
+	Dst         string
+	Protocol    string
+	PortFrom    int
+	PortTo      int
+	Description string
+}
+
+// ACLGroup is a group and the usernames of its members
+type ACLGroup struct {
+	Name    string
+	Members []string
+}
+
+// ParsePortRange reads "22", "8000-8100" or "" (every port)
+func ParsePortRange(s string) (int, int, error) {
+	if len(s) == 0 {
+		return 0, 65535, nil
+	}
+	lo, hi, found := strings.Cut(s, "-")
+	if !found {
+		hi = lo
+	}
+	from, err1 := strconv.Atoi(lo)
+	to, err2 := strconv.Atoi(hi)
+	if err1 != nil || err2 != nil || from < 0 || to > 65535 || from > to {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return from, to, nil
+}
+
+// checkACLSelector makes sure a selector names something that exists right now;
+// rules whose user or relay is removed later simply stop matching
+func checkACLSelector(ctx context.Context, q dbtx, selector string) error {
+	kind, name, found := strings.Cut(selector, ":")
+	if !found {
+		if selector == "any" || selector == "relays" {
+			return nil
+		}
+		if _, err := parseACLPrefix(selector); err != nil {
+			return fmt.Errorf("invalid selector %q: want any, relays, user:NAME, group:NAME, relay:NAME or an address", selector)
+		}
+		return nil
+	}
+	switch kind {
+	case "user":
+		_, err := resolveUser(ctx, q, name)
+		return err
+	case "group":
+		var exists bool
+		if err := q.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM acl_group_table WHERE group_name = $1)`,
+			name).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("no group named %q", name)
+		}
+		return nil
+	case "relay":
+		_, err := resolveRelay(ctx, q, name)
+		return err
+	default:
+		return fmt.Errorf("unknown selector kind %q", kind)
+	}
+}
+
+// parseACLPrefix reads an address or CIDR selector
+func parseACLPrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		return p.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return hostPrefix(addr), nil
+}
+
+// AddACLRule validates and stores a rule, returning its rule_id.
+// Relays pick it up on their next reconciliation, see NotifyRelays.
+func AddACLRule(db *sql.DB, rule ACLRule) (int64, error) {
+	if rule.Action != ACLAllow && rule.Action != ACLDeny {
+		return 0, fmt.Errorf("action must be %s or %s", ACLAllow, ACLDeny)
+	}
+	if len(rule.Protocol) == 0 {
+		rule.Protocol = "any"
+	}
+	switch rule.Protocol {
+	case "any", "icmp":
+		if rule.PortFrom != 0 || rule.PortTo != 65535 {
+			return 0, errors.New("ports only apply to tcp and udp")
+		}
+	case "tcp", "udp":
+		if rule.PortFrom < 0 || rule.PortTo > 65535 || rule.PortFrom > rule.PortTo {
+			return 0, errors.New("invalid port range")
+		}
+	default:
+		return 0, fmt.Errorf("unknown protocol %q", rule.Protocol)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, selector := range []string{rule.Src, rule.Dst} {
+		if err := checkACLSelector(ctx, db, selector); err != nil {
+			return 0, err
+		}
+	}
+	var description any
+	if len(rule.Description) != 0 {
+		description = rule.Description
+	}
+	var rule_id int64
+	err := db.QueryRowContext(ctx, `
+		INSERT INTO acl_rule_table (priority, action, src_selector, dst_selector, protocol, port_from, port_to, description)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING rule_id;`,
+		rule.Priority, rule.Action, rule.Src, rule.Dst, rule.Protocol, rule.PortFrom, rule.PortTo, description).Scan(&rule_id)
+	if err != nil {
+		return 0, fmt.Errorf("insert acl_rule_table: %w", err)
+	}
+	return rule_id, nil
+}
+
+// RemoveACLRule deletes a rule by rule_id
+func RemoveACLRule(db *sql.DB, rule_id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := db.ExecContext(ctx, `DELETE FROM acl_rule_table WHERE rule_id = $1`, rule_id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return fmt.Errorf("no rule numbered %d", rule_id)
+	}
+	return nil
+}
+
+// SetACLDefault sets what happens to packets no rule matches, ACLAllow or ACLDeny
+func SetACLDefault(db *sql.DB, action string) error {
+	if action != ACLAllow && action != ACLDeny {
+		return fmt.Errorf("default must be %s or %s", ACLAllow, ACLDeny)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `
+		UPSERT INTO acl_settings_table (settings_id, default_action, updated_at) VALUES (1, $1, now());`, action)
+	return err
+}
+
+// readACLDefault returns the default action, ACLAllow until one was set
+func readACLDefault(ctx context.Context, q dbtx) (string, error) {
+	var action string
+	err := q.QueryRowContext(ctx, `SELECT default_action FROM acl_settings_table WHERE settings_id = 1`).Scan(&action)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ACLAllow, nil
+	}
+	return action, err
+}
+
+// ListACLRules returns the default action and the rules in the order they are matched
+func ListACLRules(db *sql.DB) (string, []ACLRule, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	default_action, err := readACLDefault(ctx, db)
+	if err != nil {
+		return "", nil, err
+	}
+	rules, err := readACLRules(ctx, db)
+	return default_action, rules, err
+}
+
+func readACLRules(ctx context.Context, q dbtx) ([]ACLRule, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT rule_id, priority, action, src_selector, dst_selector, protocol, port_from, port_to, COALESCE(description, '')
+		FROM acl_rule_table ORDER BY priority, rule_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []ACLRule
+	for rows.Next() {
+		var r ACLRule
+		if err := rows.Scan(&r.RuleID, &r.Priority, &r.Action, &r.Src, &r.Dst, &r.Protocol,
+			&r.PortFrom, &r.PortTo, &r.Description); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+// CreateACLGroup adds an empty group
+func CreateACLGroup(db *sql.DB, name string) (int64, error) {
+	if n := len(name); n == 0 || n > 64 || strings.ContainsAny(name, ": ") {
+		return 0, errors.New("invalid group name! It's empty, too long or contains ':' or spaces")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var group_id int64
+	err := db.QueryRowContext(ctx, `INSERT INTO acl_group_table (group_name) VALUES ($1) RETURNING group_id`,
+		name).Scan(&group_id)
+	if err != nil {
+		return 0, fmt.Errorf("insert acl_group_table: %w", err)
+	}
+	return group_id, nil
+}
+
+// DeleteACLGroup removes a group and its memberships, refusing while a rule refers to it
+func DeleteACLGroup(db *sql.DB, name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var rules int
+	if err := tx.QueryRowContext(ctx, `
+		SELECT count(*) FROM acl_rule_table WHERE src_selector = $1 OR dst_selector = $1`,
+		"group:"+name).Scan(&rules); err != nil {
+		return err
+	}
+	if rules > 0 {
+		return fmt.Errorf("%d rule(s) still refer to group:%s, remove them first", rules, name)
+	}
+	res, err := tx.ExecContext(ctx, `DELETE FROM acl_group_table WHERE group_name = $1`, name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return fmt.Errorf("no group named %q", name)
+	}
+	return tx.Commit()
+}
+
+// SetACLGroupMembers adds (or with remove, takes out) users, given by username or user_id, of a group
+func SetACLGroupMembers(db *sql.DB, group string, users []string, remove bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var group_id int64
+	err = tx.QueryRowContext(ctx, `SELECT group_id FROM acl_group_table WHERE group_name = $1`, group).Scan(&group_id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("no group named %q", group)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		user_id, err := resolveUser(ctx, tx, user)
+		if err != nil {
+			return err
+		}
+		if remove {
+			_, err = tx.ExecContext(ctx, `DELETE FROM acl_group_member_table WHERE group_id = $1 AND user_id = $2`,
+				group_id, user_id)
+		} else {
+			_, err = tx.ExecContext(ctx, `
+				INSERT INTO acl_group_member_table (group_id, user_id) VALUES ($1, $2)
+				ON CONFLICT DO NOTHING`, group_id, user_id)
+		}
+		if err != nil {
+			return fmt.Errorf("update acl_group_member_table: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// ListACLGroups returns every group with the usernames of its live members
+func ListACLGroups(db *sql.DB) ([]ACLGroup, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT g.group_name, u.username
+		FROM acl_group_table AS g
+		LEFT JOIN acl_group_member_table AS m ON m.group_id = g.group_id
+		LEFT JOIN user_info_table AS u ON u.user_id = m.user_id AND u.deleted_at IS NULL
+		ORDER BY g.group_name, u.username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []ACLGroup
+	for rows.Next() {
+		var name string
+		var member sql.NullString
+		if err := rows.Scan(&name, &member); err != nil {
+			return nil, err
+		}
+		if len(groups) == 0 || groups[len(groups)-1].Name != name {
+			groups = append(groups, ACLGroup{Name: name})
+		}
+		if member.Valid {
+			groups[len(groups)-1].Members = append(groups[len(groups)-1].Members, member.String)
+		}
+	}
+	return groups, rows.Err()
+}
+
+// ──────────── compiled policy ──────────────────────────────────────────
+
+// addrSet is a selector resolved to addresses
+type addrSet struct {
+	any   bool
+	hosts map[netip.Addr]struct{}
+	nets  []netip.Prefix
+}
+
+func (s *addrSet) add(p netip.Prefix) {
+	if p.IsSingleIP() {
+		if s.hosts == nil {
+			s.hosts = make(map[netip.Addr]struct{})
+		}
+		s.hosts[p.Addr()] = struct{}{}
+		return
+	}
+	s.nets = append(s.nets, p)
+}
+
+func (s *addrSet) contains(addr netip.Addr) bool {
+	if s.any {
+		return true
+	}
+	if _, ok := s.hosts[addr]; ok {
+		return true
+	}
+	for _, p := range s.nets {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+type aclRule struct {
+	allow    bool
+	src, dst addrSet
+	protocol string
+	port_lo  uint16
+	port_hi  uint16
+}
+
+// matches tells whether the rule covers a packet
+func (r *aclRule) matches(p packetInfo) bool {
+	switch r.protocol {
+	case "tcp":
+		if p.protocol != protoTCP {
+			return false
+		}
+	case "udp":
+		if p.protocol != protoUDP {
+			return false
+		}
+	case "icmp":
+		if p.protocol != protoICMP && p.protocol != protoICMPv6 {
+			return false
+		}
+	}
+	if r.protocol == "tcp" || r.protocol == "udp" {
+		if p.dst_port < r.port_lo || p.dst_port > r.port_hi {
+			return false
+		}
+	}
+	return r.src.contains(p.src) && r.dst.contains(p.dst)
+}
+
+// aclPolicy is the policy as the packet filter evaluates it
+type aclPolicy struct {
+	rules         []aclRule
+	default_allow bool
+	relays        addrSet // relay to relay traffic is never filtered
+	local         addrSet // this relay's own addresses, see packetFilter.Read
+}
+
+// allows decides a packet that is not part of a tracked flow: first matching rule, else the default
+func (a *aclPolicy) allows(p packetInfo) bool {
+	if a.relays.contains(p.src) && a.relays.contains(p.dst) {
+		return true
+	}
+	for i := range a.rules {
+		if a.rules[i].matches(p) {
+			return a.rules[i].allow
+		}
+	}
+	return a.default_allow
+}
+
+// open means the filter has nothing to do
+func (a *aclPolicy) open() bool {
+	return a.default_allow && len(a.rules) == 0
+}
+
+// currentACL is the policy the packet filter enforces, nil until the first reconciliation
+var currentACL atomic.Pointer[aclPolicy]
+
+// loadACL compiles the policy from the database and hands it to the packet filter.
+// self is this relay's IPv4 overlay address. On error the previous policy stays in force.
+func loadACL(ctx context.Context, db *sql.DB, ov overlay.Config, self netip.Addr) error {
+	default_action, err := readACLDefault(ctx, db)
+	if err != nil {
+		return err
+	}
+	rules, err := readACLRules(ctx, db)
+	if err != nil {
+		return err
+	}
+	policy := &aclPolicy{default_allow: default_action == ACLAllow}
+	dual := func(set *addrSet, addr netip.Addr) {
+		for _, p := range ov.DualStack(addr) {
+			set.add(p)
+		}
+	}
+	dual(&policy.local, self)
+
+	// everything a selector can name, read once
+	users := map[string]netip.Addr{}
+	rows, err := db.QueryContext(ctx, `
+		SELECT username, latest_ip FROM user_info_table WHERE deleted_at IS NULL AND latest_ip IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var ip netip.Addr
+		if err := rows.Scan(&name, scanAddr(&ip)); err != nil {
+			return err
+		}
+		users[name] = ip
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	groups := map[string][]netip.Addr{}
+	rows, err = db.QueryContext(ctx, `
+		SELECT g.group_name, u.latest_ip
+		FROM acl_group_member_table AS m
+		JOIN acl_group_table AS g ON g.group_id = m.group_id
+		JOIN user_info_table AS u ON u.user_id = m.user_id
+		WHERE u.deleted_at IS NULL AND u.latest_ip IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var ip netip.Addr
+		if err := rows.Scan(&name, scanAddr(&ip)); err != nil {
+			return err
+		}
+		groups[name] = append(groups[name], ip)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	relays := map[string]netip.Addr{}
+	rows, err = db.QueryContext(ctx, `
+		SELECT server_id, COALESCE(server_name, ''), server_privip FROM server_info_table WHERE deleted_at IS NULL`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var name string
+		var ip netip.Addr
+		if err := rows.Scan(&id, &name, scanAddr(&ip)); err != nil {
+			return err
+		}
+		relays[strconv.FormatInt(id, 10)] = ip
+		if len(name) != 0 {
+			relays[name] = ip
+		}
+		dual(&policy.relays, ip)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	resolve := func(selector string) addrSet {
+		var set addrSet
+		kind, name, _ := strings.Cut(selector, ":")
+		switch {
+		case selector == "any":
+			set.any = true
+		case selector == "relays":
+			set = policy.relays
+		case kind == "user":
+			if ip, ok := users[name]; ok {
+				dual(&set, ip)
+			}
+		case kind == "group":
+			for _, ip := range groups[name] {
+				dual(&set, ip)
+			}
+		case kind == "relay":
+			if ip, ok := relays[name]; ok {
+				dual(&set, ip)
+			}
+		default:
+			// an address or CIDR, IPv4 ones stand for their ULA counterpart as well
+			if p, err := parseACLPrefix(selector); err == nil {
+				set.add(p)
+				if p.Addr().Is4() && ov.ULA.IsValid() {
+					set.add(overlay.EmbedPrefix6(ov.ULA, p))
+				}
+			}
+		}
+		return set
+	}
+	for _, r := range rules {
+		policy.rules = append(policy.rules, aclRule{
+			allow:    r.Action == ACLAllow,
+			src:      resolve(r.Src),
+			dst:      resolve(r.Dst),
+			protocol: r.Protocol,
+			port_lo:  uint16(r.PortFrom),
+			port_hi:  uint16(r.PortTo),
+		})
+	}
+
+	currentACL.Store(policy)
+	return nil
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		in     string
+		lo, hi int
+		ok     bool
+	}{
+		{"", 0, 65535, true},
+		{"0", 0, 0, true},
+		{"22", 22, 22, true},
+		{"65535", 65535, 65535, true},
+		{"0-65535", 0, 65535, true},
+		{"8000-8100", 8000, 8100, true},
+		{"80-80", 80, 80, true},
+		{"65536", 0, 0, false},
+		{"-1", 0, 0, false},
+		{"10-5", 0, 0, false},
+		{"1-65536", 0, 0, false},
+		{"1-", 0, 0, false},
+		{"-", 0, 0, false},
+		{"a", 0, 0, false},
+		{"22-ssh", 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			lo, hi, err := ParsePortRange(tt.in)
+			if (err == nil) != tt.ok {
+				t.Fatalf("err = %v, want ok %v", err, tt.ok)
+			}
+			if lo != tt.lo || hi != tt.hi {
+				t.Errorf("got %d-%d, want %d-%d", lo, hi, tt.lo, tt.hi)
+			}
+		})
+	}
+}
+
+func TestACLRuleMatches(t *testing.T) {
+	a, b := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	var src addrSet
+	src.add(netip.MustParsePrefix("10.0.0.0/30"))
+	var dst addrSet
+	dst.add(netip.MustParsePrefix("10.0.0.2/32"))
+	web := aclRule{src: src, dst: dst, protocol: "tcp", port_lo: 8000, port_hi: 8100}
+
+	tests := []struct {
+		name string
+		r    aclRule
+		p    packetInfo
+		want bool
+	}{
+		{"below the range", web, packetInfo{protocol: protoTCP, src: a, dst: b, dst_port: 7999}, false},
+		{"range start", web, packetInfo{protocol: protoTCP, src: a, dst: b, dst_port: 8000}, true},
+		{"range end", web, packetInfo{protocol: protoTCP, src: a, dst: b, dst_port: 8100}, true},
+		{"above the range", web, packetInfo{protocol: protoTCP, src: a, dst: b, dst_port: 8101}, false},
+		{"source port ignored", web, packetInfo{protocol: protoTCP, src: a, dst: b, src_port: 8050, dst_port: 22}, false},
+		{"other protocol", web, packetInfo{protocol: protoUDP, src: a, dst: b, dst_port: 8000}, false},
+		{"source outside", web, packetInfo{protocol: protoTCP, src: netip.MustParseAddr("10.0.0.9"), dst: b, dst_port: 8000}, false},
+		{"destination outside", web, packetInfo{protocol: protoTCP, src: a, dst: a, dst_port: 8000}, false},
+		{"full range", aclRule{src: src, dst: dst, protocol: "udp", port_lo: 0, port_hi: 65535},
+			packetInfo{protocol: protoUDP, src: a, dst: b, dst_port: 65535}, true},
+		{"icmp covers icmpv6", aclRule{src: addrSet{any: true}, dst: addrSet{any: true}, protocol: "icmp"},
+			packetInfo{protocol: protoICMPv6, src: a, dst: b, dst_port: 7}, true},
+		{"any ignores ports", aclRule{src: addrSet{any: true}, dst: addrSet{any: true}, protocol: "any", port_lo: 22, port_hi: 22},
+			packetInfo{protocol: 47, src: a, dst: b}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.r.matches(tt.p); got != tt.want {
+				t.Errorf("matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestACLPolicyAllows(t *testing.T) {
+	a, b := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	relay1, relay2 := netip.MustParseAddr("10.0.0.100"), netip.MustParseAddr("10.0.0.101")
+	anyAddr := addrSet{any: true}
+	var hostB addrSet
+	hostB.add(netip.MustParsePrefix("10.0.0.2/32"))
+	var relays addrSet
+	relays.add(netip.MustParsePrefix("10.0.0.100/32"))
+	relays.add(netip.MustParsePrefix("10.0.0.101/32"))
+
+	denySSH := aclRule{allow: false, src: anyAddr, dst: hostB, protocol: "tcp", port_lo: 22, port_hi: 22}
+	allowTCP := aclRule{allow: true, src: anyAddr, dst: hostB, protocol: "tcp", port_lo: 0, port_hi: 65535}
+	ssh := packetInfo{protocol: protoTCP, src: a, dst: b, dst_port: 22}
+	web := packetInfo{protocol: protoTCP, src: a, dst: b, dst_port: 443}
+	dns := packetInfo{protocol: protoUDP, src: a, dst: b, dst_port: 53}
+
+	tests := []struct {
+		name   string
+		policy aclPolicy
+		p      packetInfo
+		want   bool
+	}{
+		{"first match denies", aclPolicy{rules: []aclRule{denySSH, allowTCP}}, ssh, false},
+		{"first match allows", aclPolicy{rules: []aclRule{allowTCP, denySSH}}, ssh, true},
+		{"later rule matches", aclPolicy{rules: []aclRule{denySSH, allowTCP}}, web, true},
+		{"default deny", aclPolicy{rules: []aclRule{denySSH, allowTCP}}, dns, false},
+		{"default allow", aclPolicy{rules: []aclRule{denySSH}, default_allow: true}, dns, true},
+		{"default allow after deny", aclPolicy{rules: []aclRule{denySSH}, default_allow: true}, ssh, false},
+		{"no rules", aclPolicy{}, web, false},
+		{"relay to relay", aclPolicy{relays: relays},
+			packetInfo{protocol: protoTCP, src: relay1, dst: relay2, dst_port: 22}, true},
+		{"relay to client", aclPolicy{relays: relays},
+			packetInfo{protocol: protoTCP, src: relay1, dst: b, dst_port: 22}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.allows(tt.p); got != tt.want {
+				t.Errorf("allows = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -5,67 +5,123 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"net"
+	"guardedim/overlay"
+	"net/netip"
 	"time"
 
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-func AddServer(db *sql.DB, server_name string, server_pubip string, server_port uint16, server_privip string, server_pubkey string, server_presharedkey string) (int64, error) {
+// server_subnet is the CIDR block the relay owns inside supernet. Left empty a free /24 is
+// allocated, "/N" allocates a free block of that size instead.
+// server_privip may be left empty, the relay always takes host ov.RelayHost of its subnet.
+// Subnets are carved from ov.Supernet.
+func AddServer(db *sql.DB, ov overlay.Config, server_name string, server_pubip string, server_port uint16, server_privip string, server_subnet string, server_pubkey string, server_presharedkey string) (int64, string, error) {
 	// input check
 	if len(server_name) == 0 {
 		server_name = "default_server_name"
 	}
 	wgpubkey, err := wgtypes.ParseKey(server_pubkey)
 	if err != nil {
-		return -1, errors.New("invalid public key")
+		return -1, "", errors.New("invalid public key")
 	}
 	wgpsk, err := wgtypes.ParseKey(server_presharedkey)
 	if err != nil {
-		return -2, errors.New("invalid preshared key")
+		return -2, "", errors.New("invalid preshared key")
 	}
 	if n := len(server_name); n > 64 {
-		return -3, errors.New("invalid servername! it's too long")
+		return -3, "", errors.New("invalid servername! it's too long")
 	}
-	pubIP := net.ParseIP(server_pubip)
-	if pubIP == nil {
-		return -4, errors.New("invalid public IP! please check")
+	pubIP, err := netip.ParseAddr(server_pubip)
+	if err != nil {
+		return -4, "", errors.New("invalid public IP! please check")
 	}
-	privIP := net.ParseIP(server_privip)
-	if privIP == nil {
-		return -5, errors.New("invalid private IP! please check")
+	var privIP netip.Addr
+	if len(server_privip) != 0 {
+		if privIP, err = netip.ParseAddr(server_privip); err != nil || !privIP.Is4() {
+			return -5, "", errors.New("invalid private IP! please check")
+		}
 	}
-
-	// ensure private IP falls within 10.0.0.0/8
-	_, subnet10, _ := net.ParseCIDR("10.0.0.0/8")
-	if !subnet10.Contains(privIP) {
-		return -6, errors.New("invalid private IP: must be within 10.0.0.0/8")
+	super_net := ov.Supernet
+	subnet, prefix_len, err := parseRelaySubnetRequest(server_subnet)
+	if err != nil {
+		return -9, "", err
 	}
 
-	// database operation
-	pubIP16 := pubIP.To16()
-	privIP16 := privIP.To16()
-	wgpubkeyBytes := wgpubkey[:]
-	wgpskBytes := wgpsk[:]
+	// ensure the relay's block falls within the overlay supernet
+	if subnet.IsValid() {
+		if !super_net.Contains(subnet.Addr()) || prefix_len < super_net.Bits() {
+			return -6, "", fmt.Errorf("invalid subnet: must be within %s", super_net)
+		}
+	} else if privIP.IsValid() && !super_net.Contains(privIP) {
+		return -6, "", fmt.Errorf("invalid private IP: must be within %s", super_net)
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	var new_server_id int64
+	var allocated string
+	err = withRetry(ctx, db, func(tx *sql.Tx) error {
+		var err error
+		new_server_id, allocated, err = addServerTx(ctx, tx, ov, server_name, pubIP, server_port, privIP, subnet, prefix_len, wgpubkey, wgpsk)
+		return err
+	})
+	if err != nil && new_server_id >= 0 {
+		return -7, "", fmt.Errorf("error when inserting into Relay Server Table: %w", err)
+	}
+	return new_server_id, allocated, err
+}
+
+// addServerTx checks the relay's block against every existing one (or picks the next free one)
+// and inserts the relay inside the caller's transaction
+func addServerTx(ctx context.Context, tx *sql.Tx, ov overlay.Config, server_name string, pubIP netip.Addr, server_port uint16, privIP netip.Addr,
+	subnet netip.Prefix, prefix_len int, wgpubkey wgtypes.Key, wgpsk wgtypes.Key) (int64, string, error) {
 	const addserver_sql = `
 			INSERT INTO server_info_table
-            (server_name, server_pubip, server_port, server_privip, server_pubkey, server_presharedkey)
-        	VALUES ($1, $2, $3, $4, $5, $6)
+            (server_name, server_pubip, server_port, server_privip, server_subnet, server_pubkey, server_presharedkey)
+        	VALUES ($1, $2, $3, $4, $5, $6, $7)
         	RETURNING server_id;`
+
+	existing, err := existingRelaySubnets(ctx, tx)
+	if err != nil {
+		return -7, "", fmt.Errorf("read relay subnets: %w", err)
+	}
+	if !subnet.IsValid() {
+		if subnet, err = allocateRelaySubnet(existing, ov.Supernet, prefix_len); err != nil {
+			return -10, "", err
+		}
+	} else {
+		for _, e := range existing {
+			if subnet.Overlaps(e) {
+				return -11, "", fmt.Errorf("subnet %s overlaps relay subnet %s", subnet, e)
+			}
+		}
+	}
+
+	relay_ip := ov.RelayAddr(subnet)
+	if !relay_ip.IsValid() {
+		return -8, "", fmt.Errorf("subnet %s has no host number %d for the relay", subnet, ov.RelayHost)
+	}
+	if privIP.IsValid() && privIP != relay_ip {
+		return -5, "", fmt.Errorf("invalid private IP: the relay of %s must use %s", subnet, relay_ip)
+	}
+
+	// database operation
+	wgpubkeyBytes := wgpubkey[:]
+	wgpskBytes := wgpsk[:]
+
 	var new_server_id int64
-	err = db.QueryRowContext(ctx, addserver_sql,
+	err = tx.QueryRowContext(ctx, addserver_sql,
 		server_name,
-		pubIP16,
+		pubIP,
 		server_port,
-		privIP16,
+		relay_ip,
+		subnet,
 		wgpubkeyBytes,
 		wgpskBytes).Scan(&new_server_id)
 	if err != nil {
-		return -7, fmt.Errorf("error when inserting into Relay Server Table: %w", err)
+		return -7, "", fmt.Errorf("error when inserting into Relay Server Table: %w", err)
 	}
-	return new_server_id, nil
+	return new_server_id, subnet.String(), nil
 }
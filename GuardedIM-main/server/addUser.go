@@ -5,18 +5,61 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"net/netip"
 	"time"
 	"unicode/utf8"
 
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-func AddUser(db *sql.DB, username string, display_name string, pubkey string, latest_ip string) (int64, error) {
+// signing_pubkey is the user's base64 ed25519 control-plane key, it may be left empty and registered later.
+// relay is the name or server_id of the user's home relay; it may be empty when latest_ip
+// already tells the relay apart or when there is only one relay.
+// latest_ip may be empty, a free address of the relay's user subnet is allocated then.
+// expires_at is when the account stops working, the zero Time means never.
+// It returns the new user_id, or a negative code along with the error.
+func AddUser(db *sql.DB, username string, display_name string, pubkey string, signing_pubkey string, relay string, latest_ip string, expires_at time.Time) (int64, error) {
 	// input check
 	wgpubkey, err := wgtypes.ParseKey(pubkey)
 	if err != nil {
 		return -1, errors.New("invalid public key")
 	}
+	if code, err := checkUserNames(username, display_name); err != nil {
+		return code, err
+	}
+	var signkey []byte
+	if len(signing_pubkey) != 0 {
+		if signkey, err = parseSigningKey(signing_pubkey); err != nil {
+			return -7, err
+		}
+	}
+	var wanted_ip netip.Addr
+	if len(latest_ip) != 0 {
+		if wanted_ip, err = netip.ParseAddr(latest_ip); err != nil || !wanted_ip.Is4() {
+			return -8, errors.New("invalid user IP! please check")
+		}
+	}
+	if !expires_at.IsZero() && !expires_at.After(time.Now()) {
+		return -13, errors.New("expiry lies in the past")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var new_user_id int64
+	err = withRetry(ctx, db, func(tx *sql.Tx) error {
+		var err error
+		new_user_id, err = insertUserTx(ctx, tx, username, display_name, wgpubkey, signkey, relay, wanted_ip, expires_at)
+		return err
+	})
+	if err != nil && new_user_id >= 0 {
+		return -6, fmt.Errorf("commit user: %w", err)
+	}
+	return new_user_id, err
+}
+
+// checkUserNames validates a new user's username and display name, returning AddUser's error codes
+func checkUserNames(username string, display_name string) (int64, error) {
 	if n := len(username); n <= 0 || n > 64 {
 		return -2, errors.New("invalid username! It's empty or too long")
 	}
@@ -31,23 +74,51 @@ func AddUser(db *sql.DB, username string, display_name string, pubkey string, la
 	if n := len(display_name); n <= 0 || n > 128 {
 		return -5, errors.New("display name too long! Please choose a shorter one")
 	}
+	return 0, nil
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancel()
-
+// insertUserTx resolves the home relay, picks the address and inserts the user inside the
+// caller's transaction, so enrollment can redeem an invite and create the user atomically
+func insertUserTx(ctx context.Context, tx *sql.Tx, username string, display_name string, wgpubkey wgtypes.Key, signkey []byte, relay string, wanted_ip netip.Addr, expires_at time.Time) (int64, error) {
 	const add_user_sql = `
 		INSERT INTO user_info_table
-			(username, display_name, user_pubkey, latest_ip)
-		VALUES ($1, $2, $3, $4)
+			(username, display_name, user_pubkey, latest_ip, home_server_id, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
 		RETURNING user_id;
 	`
+	var err error
+
+	// ---- IPAM ----
+	var home relayInfo
+	if len(relay) != 0 {
+		home, err = resolveRelay(ctx, tx, relay)
+	} else {
+		home, err = relayForIP(ctx, tx, wanted_ip)
+	}
+	if err != nil {
+		return -9, fmt.Errorf("cannot pick the home relay: %w", err)
+	}
+	ip := wanted_ip
+	if !ip.IsValid() {
+		if ip, err = allocateUserIP(ctx, tx, home); err != nil {
+			return -10, err
+		}
+	} else if !isHostAddr(ip, home.Subnet) || ip == home.PrivIP {
+		return -8, fmt.Errorf("user IP must be a host address of %s", home.Subnet)
+	}
 
+	var expiry any
+	if !expires_at.IsZero() {
+		expiry = expires_at
+	}
 	var new_user_id int64
-	err = db.QueryRowContext(ctx, add_user_sql,
+	err = tx.QueryRowContext(ctx, add_user_sql,
 		username,
 		display_name,
 		wgpubkey[:], // []byte{32}
-		[]byte(latest_ip),
+		ip,
+		home.ID,
+		expiry,
 	).Scan(&new_user_id)
 	if err != nil {
 		if err == context.DeadlineExceeded {
@@ -56,5 +127,10 @@ func AddUser(db *sql.DB, username string, display_name string, pubkey string, la
 		return -6, fmt.Errorf("insert user_info_table: %w", err)
 	}
 
+	if signkey != nil {
+		if err := setSigningKeyTx(ctx, tx, new_user_id, signkey); err != nil {
+			return -6, err
+		}
+	}
 	return new_user_id, nil
 }
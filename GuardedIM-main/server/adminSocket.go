@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"guardedim/overlay"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultAdminSocket is where gdimd listens for local admin requests from gdim
+const DefaultAdminSocket = "/run/gdimd.sock"
+
+// AdminSocketPath returns the configured socket, or the default one of the instance running iface:
+// DefaultAdminSocket for wg0 and /run/gdimd-<iface>.sock otherwise, so instances don't collide
+func AdminSocketPath(sock_path string, iface string) string {
+	if sock_path != "" {
+		return sock_path
+	}
+	if iface == "" || iface == overlay.DefaultInterface {
+		return DefaultAdminSocket
+	}
+	return "/run/gdimd-" + iface + ".sock"
+}
+
+// InitializeAdminSocket serves the local admin channel of gdimd over a Unix socket.
+// Only root (the socket is 0600) can talk to it, so no further authentication is done.
+func InitializeAdminSocket(ctx context.Context, db *sql.DB, sock_path string, ov overlay.Config) error {
+	sock_path = AdminSocketPath(sock_path, ov.Interface)
+
+	// a crashed daemon leaves the socket file behind
+	if err := os.Remove(sock_path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove stale socket: %w", err)
+	}
+	ln, err := net.Listen("unix", sock_path)
+	if err != nil {
+		return fmt.Errorf("listen admin socket: %w", err)
+	}
+	if err := os.Chmod(sock_path, 0600); err != nil {
+		ln.Close()
+		return fmt.Errorf("chmod admin socket: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/updateconn", httpHandleUpdateConn(db, ov))
+
+	srv := &http.Server{
+		Handler:     mux,
+		ReadTimeout: 5 * time.Second,
+		// reconciliation talks to the database, give it more room than the control server
+		WriteTimeout: 30 * time.Second,
+	}
+
+	// graceful shutdown when ctx is cancelled
+	go func() {
+		<-ctx.Done()
+		shutCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutCtx)
+	}()
+
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// httpHandleUpdateConn re-runs peer reconciliation and returns the PeerChanges
+func httpHandleUpdateConn(db *sql.DB, ov overlay.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		changes, err := UpdateConnection(db, ov)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(changes)
+	}
+}
+
+// AdminRequest POSTs to an endpoint of a running gdimd's admin socket and decodes the JSON reply into out
+func AdminRequest(sock_path string, endpoint string, out any) error {
+	if sock_path == "" {
+		sock_path = DefaultAdminSocket
+	}
+	httpClient := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", sock_path)
+			},
+		},
+	}
+
+	// the host part is ignored, the transport always dials the socket
+	resp, err := httpClient.Post("http://gdimd"+endpoint, "application/json", nil)
+	if err != nil {
+		return fmt.Errorf("contact gdimd: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("gdimd: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
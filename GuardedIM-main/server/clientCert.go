@@ -0,0 +1,121 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ClientCertValidity is how long a client certificate issued at enrollment stays valid
+const ClientCertValidity = 365 * 24 * time.Hour
+
+// clientCertCNPrefix starts the common name of every issued client certificate. The CA may
+// be the database's as well, which maps a client certificate's CN to a SQL user; ':' is not
+// allowed in SQL usernames, so an enrolled user can never log into the database.
+const clientCertCNPrefix = "gdim:"
+
+// clientIssuer signs the CSRs enrolling clients send with the control server's CA
+type clientIssuer struct {
+	ca  *x509.Certificate
+	key crypto.Signer
+}
+
+// loadClientIssuer reads ca.key next to ca.crt. Without ca.key it returns nil:
+// enrollment then works as before, but hands out no client certificate.
+func loadClientIssuer(certDir string, caPem []byte) (*clientIssuer, error) {
+	keyPem, err := os.ReadFile(filepath.Join(certDir, "ca.key"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read ca key: %w", err)
+	}
+	block, _ := pem.Decode(caPem)
+	if block == nil {
+		return nil, errors.New("no certificate in ca.crt")
+	}
+	ca, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse ca: %w", err)
+	}
+	block, _ = pem.Decode(keyPem)
+	if block == nil {
+		return nil, errors.New("no key in ca.key")
+	}
+	key, err := parsePrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse ca key: %w", err)
+	}
+	if pub, ok := ca.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(key.Public()) {
+		return nil, errors.New("ca.key does not belong to ca.crt")
+	}
+	return &clientIssuer{ca: ca, key: key}, nil
+}
+
+// parsePrivateKey reads a PKCS #8, PKCS #1 or SEC 1 private key
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("unsupported private key")
+}
+
+// parseCSR decodes a PEM certificate request and checks its self-signature
+func parseCSR(csr_pem string) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode([]byte(csr_pem))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("no certificate request in csr")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid csr: %w", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid csr: %w", err)
+	}
+	return csr, nil
+}
+
+// issue signs csr_pem as a client certificate for username and returns it in PEM.
+// Only the public key is taken from the request; subject, lifetime and usage are the issuer's.
+func (i *clientIssuer) issue(csr_pem string, username string) (string, error) {
+	csr, err := parseCSR(csr_pem)
+	if err != nil {
+		return "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: clientCertCNPrefix + username},
+		NotBefore:    now.Add(-5 * time.Minute),
+		NotAfter:     now.Add(ClientCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, i.ca, csr.PublicKey, i.key)
+	if err != nil {
+		return "", fmt.Errorf("sign client certificate: %w", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), nil
+}
@@ -2,24 +2,55 @@ package server
 
 import (
 	"context"
-	"crypto/ed25519"
 	"crypto/rand"
 	"database/sql"
-	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
-	"net"
+	"errors"
+	"guardedim/overlay"
 	"net/http"
+	"net/netip"
 	"time"
 )
 
 type RelayRow struct {
-	ServerID   uint64 `json:"id"`
-	ServerName string `json:"name,omitempty"`
-	PubIP      []byte `json:"pub_ip"`
-	Port       uint16 `json:"port"`
-	PrivIP     []byte `json:"priv_ip"`
-	PubKey     []byte `json:"pub_key"`
+	ServerID   uint64       `json:"id"`
+	ServerName string       `json:"name,omitempty"`
+	PubIP      netip.Addr   `json:"pub_ip"`
+	Port       uint16       `json:"port"`
+	PrivIP     netip.Addr   `json:"priv_ip"`
+	Subnet     netip.Prefix `json:"subnet"`
+	PubKey     []byte       `json:"pub_key"`
+}
+
+// relayTable reads every live relay the way /relay-table serves it
+func relayTable(ctx context.Context, q dbtx) ([]RelayRow, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT server_id, server_name, server_pubip, server_port, server_privip, server_subnet, server_pubkey
+		FROM server_info_table
+		WHERE deleted_at IS NULL`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []RelayRow
+	for rows.Next() {
+		var row RelayRow
+		var name sql.NullString
+		if err := rows.Scan(&row.ServerID,
+			&name,
+			scanAddr(&row.PubIP),
+			&row.Port,
+			scanAddr(&row.PrivIP),
+			scanPrefix(&row.Subnet),
+			&row.PubKey); err != nil {
+			return nil, err
+		}
+		row.ServerName = name.String
+		list = append(list, row)
+	}
+	return list, rows.Err()
 }
 
 func httpHandleRelayTable(db *sql.DB) http.HandlerFunc {
@@ -32,84 +63,57 @@ func httpHandleRelayTable(db *sql.DB) http.HandlerFunc {
 		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
 		defer cancel()
 
-		rows, err := db.QueryContext(ctx, `
-		SELECT server_id, server_name, server_pubip, server_port, server_privip, server_pubkey
-		FROM server_info_table`)
+		list, err := relayTable(ctx, db)
 		if err != nil {
 			http.Error(w, "db query failed", http.StatusInternalServerError)
 			return
 		}
-		defer rows.Close()
-
-		var list []RelayRow
-		for rows.Next() {
-			var row RelayRow
-			if err := rows.Scan(&row.ServerID,
-				&row.ServerName,
-				&row.PubIP,
-				&row.Port,
-				&row.PrivIP,
-				&row.PubKey); err != nil {
-				http.Error(w, "scan error", http.StatusInternalServerError)
-				return
-
-			}
-			list = append(list, row)
-		}
-		if rows.Err() != nil {
-			http.Error(w, "rows error", http.StatusInternalServerError)
-			return
-		}
 		w.Header().Set("Content-Type", "application/json")
 		_ = json.NewEncoder(w).Encode(list)
 	}
 }
 
-// nonceEntry holds the nonce bytes and expiry timestamp
-type nonceEntry struct {
-	val    []byte
-	expiry time.Time
-}
+// every challenge nonce expires after nonceTTL
+const nonceTTL = 30 * time.Second
 
-// globalNonceStore is now map[user_id]nonceEntry
-var globalNonceStore = make(map[uint64]nonceEntry)
+// issueChallenge stores a fresh single-use nonce for user_id and sends it back as {nonce: "<hex>"}
+func issueChallenge(w http.ResponseWriter, r *http.Request, nonces NonceStore, user_id uint64) {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		http.Error(w, "rand", http.StatusInternalServerError)
+		return
+	}
+	if err := nonces.Put(r.Context(), user_id, nonce, nonceTTL); err != nil {
+		http.Error(w, "nonce store", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Nonce string `json:"nonce"`
+	}{Nonce: hex.EncodeToString(nonce)})
+}
 
 // httpHandleReplaceIP serves BOTH phases:
 //   - Phase‑1 challenge:  client POSTs  {user_id, ip_address}
 //     ↳ server returns   {nonce: "<hex>"}
 //   - Phase‑2 verify:    client POSTs  {user_id, ip_address, sig: "<base64>"}
-//     ↳ server returns   {free: bool, written: bool}
+//     ↳ server returns   {free: bool, written: bool, ip_address}
 //
-// A nonce is single‑use and stored only in RAM.  It expires after 30 s.
-func httpHandleReplaceIP(db *sql.DB) http.HandlerFunc {
+// sig covers nonce‖"/ip/replace"‖0‖ip_address, so the address cannot be swapped underneath it.
+// An empty ip_address asks for the lowest free address of the user's home relay subnet.
+// A nonce is single‑use and kept in the NonceStore.  It expires after 30 s.
+func httpHandleReplaceIP(db *sql.DB, nonces NonceStore, ov overlay.Config, notify func()) http.HandlerFunc {
 	type request struct {
 		UserID    uint64 `json:"user_id"`
 		IPAddress string `json:"ip_address"`
 		SigB64    string `json:"sig,omitempty"`
 	}
-	type respChallenge struct {
-		Nonce string `json:"nonce"`
-	}
 	type respResult struct {
-		Free    bool `json:"free"`
-		Written bool `json:"written"`
+		Free      bool   `json:"free"`
+		Written   bool   `json:"written"`
+		IPAddress string `json:"ip_address"`
 	}
 
-	const nonceTTL = 30 * time.Second
-
-	// background goroutine to purge stale nonces
-	go func() {
-		for {
-			time.Sleep(nonceTTL)
-			now := time.Now()
-			for uid, entry := range globalNonceStore {
-				if now.After(entry.expiry) {
-					delete(globalNonceStore, uid)
-				}
-			}
-		}
-	}()
-
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "POST only", http.StatusMethodNotAllowed)
@@ -120,70 +124,138 @@ func httpHandleReplaceIP(db *sql.DB) http.HandlerFunc {
 			http.Error(w, "bad json", http.StatusBadRequest)
 			return
 		}
-		// basic IP validity check
-		if net.ParseIP(req.IPAddress) == nil {
-			http.Error(w, "invalid ip", http.StatusBadRequest)
-			return
+		// basic IP validity check, empty means allocate
+		var ip netip.Addr
+		if req.IPAddress != "" {
+			var err error
+			if ip, err = netip.ParseAddr(req.IPAddress); err != nil {
+				http.Error(w, "invalid ip", http.StatusBadRequest)
+				return
+			}
 		}
 
 		// ---- Phase 1: challenge ----
 		if req.SigB64 == "" {
-			nonce := make([]byte, 32)
-			if _, err := rand.Read(nonce); err != nil {
-				http.Error(w, "rand", http.StatusInternalServerError)
-				return
-			}
-			globalNonceStore[req.UserID] = nonceEntry{val: nonce, expiry: time.Now().Add(nonceTTL)}
-			w.Header().Set("Content-Type", "application/json")
-			_ = json.NewEncoder(w).Encode(respChallenge{Nonce: hex.EncodeToString(nonce)})
+			issueChallenge(w, r, nonces, req.UserID)
 			return
 		}
 
 		// ---- Phase 2: verify signature ----
-		entry, ok := globalNonceStore[req.UserID]
-		if !ok || time.Now().After(entry.expiry) {
+		nonce, err := nonces.Consume(r.Context(), req.UserID)
+		if err != nil {
 			http.Error(w, "no nonce", http.StatusForbidden)
 			return
 		}
-		delete(globalNonceStore, req.UserID) // single-use
+		msg := signedMessage(nonce, "/ip/replace", []byte(req.IPAddress))
+		if err := verifyUserSignature(r.Context(), db, req.UserID, msg, req.SigB64); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
 
-		sig, err := base64.StdEncoding.DecodeString(req.SigB64)
+		// ---- IPAM: users stay inside their home relay's subnet ----
+		home, err := userHomeRelay(r.Context(), db, req.UserID)
 		if err != nil {
-			http.Error(w, "bad sig encoding", http.StatusBadRequest)
+			http.Error(w, "db error", http.StatusInternalServerError)
 			return
 		}
-		var pubKey []byte
-		if err := db.QueryRow(`SELECT user_pubkey FROM user_info_table WHERE user_id=$1`, req.UserID).
-			Scan(&pubKey); err != nil {
-			http.Error(w, "user not found", http.StatusForbidden)
+		if !ip.IsValid() {
+			if !home.Subnet.IsValid() {
+				http.Error(w, "no home relay to allocate from", http.StatusBadRequest)
+				return
+			}
+			ip, err = claimFreeIP(r.Context(), db, home, req.UserID)
+			if errors.Is(err, ErrSubnetFull) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, "update fail", http.StatusInternalServerError)
+				return
+			}
+			notify()
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(respResult{Free: true, Written: true, IPAddress: ip.String()})
 			return
 		}
-		if !ed25519.Verify(pubKey, entry.val, sig) {
-			http.Error(w, "signature fail", http.StatusForbidden)
+		if home.Subnet.IsValid() && (!isHostAddr(ip, home.Subnet) || ip == home.PrivIP) {
+			http.Error(w, "ip outside home relay subnet", http.StatusBadRequest)
+			return
+		}
+		if !home.Subnet.IsValid() && (!ip.Is4() || !ov.Supernet.Contains(ip)) {
+			http.Error(w, "ip outside the overlay supernet", http.StatusBadRequest)
 			return
 		}
 
 		// ---- check IP and update ----
-		var occupiedBy uint64
-		e := db.QueryRow(`SELECT user_id FROM user_info_table WHERE latest_ip = $1`, req.IPAddress).Scan(&occupiedBy)
-		if e != nil && e != sql.ErrNoRows {
-			http.Error(w, "db error", http.StatusInternalServerError)
+		free, written, err := replaceIP(r.Context(), db, req.UserID, ip)
+		if err != nil {
+			http.Error(w, "update fail", http.StatusInternalServerError)
 			return
 		}
-		free := e == sql.ErrNoRows || occupiedBy == req.UserID
-		written := false
-		if free {
-			res, err := db.Exec(`UPDATE user_info_table SET latest_ip = $1 WHERE user_id = $2`, req.IPAddress, req.UserID)
-			if err != nil {
-				http.Error(w, "update fail", http.StatusInternalServerError)
-				return
-			}
-			if n, _ := res.RowsAffected(); n == 1 {
-				written = true
-			}
+		if written {
+			notify()
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(respResult{Free: free, Written: written})
+		_ = json.NewEncoder(w).Encode(respResult{Free: free, Written: written, IPAddress: ip.String()})
+	}
+}
+
+// replaceIP records ip as the user's latest_ip unless another user or a relay holds it.
+// The check and the write share a transaction; a concurrent claim of the same address
+// surfaces as a unique violation and is reported as taken.
+func replaceIP(ctx context.Context, db *sql.DB, user_id uint64, ip netip.Addr) (bool, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, false, err
+	}
+	defer tx.Rollback()
+
+	var taken bool
+	if err := tx.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM user_info_table WHERE latest_ip = $1 AND user_id <> $2)
+			OR EXISTS (SELECT 1 FROM server_info_table WHERE server_privip = $1 AND deleted_at IS NULL)`,
+		ip, int64(user_id)).Scan(&taken); err != nil {
+		return false, false, err
+	}
+	if taken {
+		return false, false, nil
 	}
+	res, err := tx.ExecContext(ctx, `UPDATE user_info_table SET latest_ip = $1 WHERE user_id = $2`, ip, int64(user_id))
+	if isUniqueViolation(err) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return true, false, nil
+	}
+	err = tx.Commit()
+	if isUniqueViolation(err) {
+		return false, false, nil
+	}
+	return true, err == nil, err
+}
+
+// claimFreeIP allocates the lowest free host address of the home relay's subnet and records
+// it as the user's latest_ip
+func claimFreeIP(ctx context.Context, db *sql.DB, home relayInfo, user_id uint64) (netip.Addr, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var ip netip.Addr
+	err := withRetry(ctx, db, func(tx *sql.Tx) error {
+		var err error
+		if ip, err = allocateUserIP(ctx, tx, home); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE user_info_table SET latest_ip = $1 WHERE user_id = $2`,
+			ip, int64(user_id))
+		return err
+	})
+	return ip, err
 }
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+	"unicode/utf8"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// UserEdit lists what EditUser changes, empty fields are left as they are
+type UserEdit struct {
+	DisplayName string
+	PubKey      string // new WireGuard public key, e.g. for a replacement device
+	Relay       string // name or server_id of the new home relay
+	LatestIP    string // new overlay address, allocated from the (new) home relay's subnet when empty
+}
+
+// EditUser changes a live user, given by username or user_id, keeping its user_id.
+// Moving to another relay without LatestIP allocates a free address there; a LatestIP
+// without Relay has to lie in the current home relay's subnet or identify another relay.
+// Running relays pick the change up on their next reconciliation, see NotifyRelays.
+func EditUser(db *sql.DB, user string, edit UserEdit) (int64, error) {
+	if len(user) == 0 {
+		return -2, errors.New("no user given")
+	}
+	if edit == (UserEdit{}) {
+		return -2, errors.New("nothing to change")
+	}
+	var wgpubkey wgtypes.Key
+	var err error
+	if len(edit.PubKey) != 0 {
+		if wgpubkey, err = wgtypes.ParseKey(edit.PubKey); err != nil {
+			return -1, errors.New("invalid public key")
+		}
+	}
+	if len(edit.DisplayName) != 0 {
+		if !utf8.ValidString(edit.DisplayName) {
+			return -4, errors.New("illegal display name! It's not a valid UTF8 string")
+		}
+		if len(edit.DisplayName) > 128 {
+			return -5, errors.New("display name too long! Please choose a shorter one")
+		}
+	}
+	var wanted_ip netip.Addr
+	if len(edit.LatestIP) != 0 {
+		if wanted_ip, err = netip.ParseAddr(edit.LatestIP); err != nil || !wanted_ip.Is4() {
+			return -8, errors.New("invalid user IP! please check")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var user_id int64
+	err = withRetry(ctx, db, func(tx *sql.Tx) error {
+		var err error
+		user_id, err = editUserTx(ctx, tx, user, edit, wgpubkey, wanted_ip)
+		return err
+	})
+	if err != nil && user_id >= 0 {
+		return -6, fmt.Errorf("commit user: %w", err)
+	}
+	return user_id, err
+}
+
+// editUserTx applies a UserEdit inside the caller's transaction
+func editUserTx(ctx context.Context, tx *sql.Tx, user string, edit UserEdit, wgpubkey wgtypes.Key, wanted_ip netip.Addr) (int64, error) {
+	user_id, err := resolveUser(ctx, tx, user)
+	if err != nil {
+		return -2, err
+	}
+
+	if len(edit.DisplayName) != 0 {
+		if _, err := tx.ExecContext(ctx, `UPDATE user_info_table SET display_name = $1 WHERE user_id = $2`,
+			edit.DisplayName, user_id); err != nil {
+			return -6, fmt.Errorf("update display name: %w", err)
+		}
+	}
+
+	if len(edit.PubKey) != 0 {
+		// tombstoned users keep their key reserved as well
+		var owner int64
+		err := tx.QueryRowContext(ctx, `SELECT user_id FROM user_info_table WHERE user_pubkey = $1`, wgpubkey[:]).Scan(&owner)
+		if err == nil && owner != user_id {
+			return -11, fmt.Errorf("public key already belongs to user %d", owner)
+		}
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return -6, err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE user_info_table SET user_pubkey = $1 WHERE user_id = $2`,
+			wgpubkey[:], user_id); err != nil {
+			return -6, fmt.Errorf("update public key: %w", err)
+		}
+	}
+
+	if len(edit.Relay) != 0 || wanted_ip.IsValid() {
+		// ---- IPAM ----
+		var home relayInfo
+		switch {
+		case len(edit.Relay) != 0:
+			home, err = resolveRelay(ctx, tx, edit.Relay)
+		default:
+			if home, err = userHomeRelay(ctx, tx, uint64(user_id)); err == nil && !home.Subnet.Contains(wanted_ip) {
+				home, err = relayForIP(ctx, tx, wanted_ip)
+			}
+		}
+		if err != nil {
+			return -9, fmt.Errorf("cannot pick the home relay: %w", err)
+		}
+
+		ip := wanted_ip
+		if !ip.IsValid() {
+			if ip, err = allocateUserIP(ctx, tx, home); err != nil {
+				return -10, err
+			}
+		} else if !isHostAddr(ip, home.Subnet) || ip == home.PrivIP {
+			return -8, fmt.Errorf("user IP must be a host address of %s", home.Subnet)
+		}
+
+		var owner int64
+		err := tx.QueryRowContext(ctx, `SELECT user_id FROM user_info_table WHERE latest_ip = $1`, ip).Scan(&owner)
+		if err == nil && owner != user_id {
+			return -12, fmt.Errorf("%s already belongs to user %d", ip, owner)
+		}
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return -6, err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE user_info_table SET latest_ip = $1, home_server_id = $2 WHERE user_id = $3`,
+			ip, home.ID, user_id); err != nil {
+			return -6, fmt.Errorf("move user: %w", err)
+		}
+	}
+
+	return user_id, nil
+}
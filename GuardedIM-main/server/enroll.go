@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"guardedim/overlay"
+	"log"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// EnrollRequest is what a new client sends to /enroll
+type EnrollRequest struct {
+	Token       string `json:"token"`
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name,omitempty"` // defaults to the username
+	PubKey      string `json:"pub_key"`                // WireGuard public key
+	SigningKey  string `json:"signing_key"`            // ed25519 public key, base64
+	CSR         string `json:"csr,omitempty"`          // PEM certificate request for the client certificate
+}
+
+// EnrollResult is what a new client needs to come up: its user_id, its overlay address, the relays,
+// the overlay they run and, when it sent a CSR, the client certificate for the mTLS-only endpoints.
+// In approval mode /enroll answers with Status "pending", RequestID and Secret instead, and
+// /enroll/status fills in the rest once an admin approved the request.
+type EnrollResult struct {
+	UserID          int64        `json:"user_id"`
+	LatestIP        netip.Addr   `json:"latest_ip"`
+	Relays          []RelayRow   `json:"relays"`
+	OverlaySupernet netip.Prefix `json:"overlay_supernet"`
+	OverlayULA      netip.Prefix `json:"overlay_ula_prefix"`
+	Certificate     string       `json:"certificate,omitempty"` // PEM, signed by the control server's CA
+
+	Status    string `json:"status"`
+	RequestID int64  `json:"request_id,omitempty"`
+	Secret    string `json:"secret,omitempty"` // only in the answer to /enroll
+	Reason    string `json:"reason,omitempty"` // why the request was rejected
+}
+
+// status of an enrollment (request)
+const (
+	EnrollPending  = "pending"
+	EnrollApproved = "approved"
+	EnrollRejected = "rejected"
+)
+
+// enrollment_mode values: open lets /enroll create the user at once, approval files a request
+// an admin has to approve (gdim pending)
+const (
+	EnrollmentOpen     = "open"
+	EnrollmentApproval = "approval"
+)
+
+// checkEnrollmentMode validates an enrollment_mode setting, empty means EnrollmentOpen
+func checkEnrollmentMode(mode string) (string, error) {
+	switch mode {
+	case "", EnrollmentOpen:
+		return EnrollmentOpen, nil
+	case EnrollmentApproval:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown enrollment mode %q", mode)
+	}
+}
+
+// errEnrollRefused marks errors caused by the request rather than the server
+type errEnrollRefused struct{ error }
+
+// EnrollUser redeems an invite and creates the user it was issued for, in one transaction,
+// so a token is spent only when the user was actually created. issuer signs the CSR of req
+// inside that transaction, a certificate that cannot be issued leaves the invite unspent.
+func EnrollUser(db *sql.DB, req EnrollRequest, issuer *clientIssuer) (EnrollResult, error) {
+	req, wgpubkey, signkey, err := checkEnrollRequest(req)
+	if err != nil {
+		return EnrollResult{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var result EnrollResult
+	err = withRetry(ctx, db, func(tx *sql.Tx) error {
+		var err error
+		result, err = enrollUserTx(ctx, tx, req, wgpubkey, signkey, issuer)
+		return err
+	})
+	return result, err
+}
+
+// checkEnrollRequest parses the keys of req and fills in the display name
+func checkEnrollRequest(req EnrollRequest) (EnrollRequest, wgtypes.Key, []byte, error) {
+	wgpubkey, err := wgtypes.ParseKey(req.PubKey)
+	if err != nil {
+		return req, wgpubkey, nil, errEnrollRefused{errors.New("invalid public key")}
+	}
+	signkey, err := parseSigningKey(req.SigningKey)
+	if err != nil {
+		return req, wgpubkey, nil, errEnrollRefused{err}
+	}
+	if len(req.DisplayName) == 0 {
+		req.DisplayName = req.Username
+	}
+	if _, err := checkUserNames(req.Username, req.DisplayName); err != nil {
+		return req, wgpubkey, nil, errEnrollRefused{err}
+	}
+	if len(req.CSR) != 0 {
+		if _, err := parseCSR(req.CSR); err != nil {
+			return req, wgpubkey, nil, errEnrollRefused{err}
+		}
+	}
+	return req, wgpubkey, signkey, nil
+}
+
+// enrollUserTx is EnrollUser inside the caller's transaction
+func enrollUserTx(ctx context.Context, tx *sql.Tx, req EnrollRequest, wgpubkey wgtypes.Key, signkey []byte, issuer *clientIssuer) (EnrollResult, error) {
+	var result EnrollResult
+
+	claims, err := redeemInviteTx(ctx, tx, req.Token)
+	if err != nil {
+		return result, errEnrollRefused{err}
+	}
+
+	if err := checkEnrollTaken(ctx, tx, req.Username, wgpubkey); err != nil {
+		return result, err
+	}
+
+	var relay string
+	if claims.Relay != 0 {
+		relay = strconv.FormatInt(claims.Relay, 10)
+	}
+	if result.UserID, err = insertUserTx(ctx, tx, req.Username, req.DisplayName, wgpubkey, signkey, relay, netip.Addr{}, time.Time{}); err != nil {
+		if isRetryable(err) {
+			return result, err
+		}
+		return result, errEnrollRefused{err}
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE invite_table SET redeemed_by = $1 WHERE invite_id = $2`,
+		result.UserID, claims.ID); err != nil {
+		return result, err
+	}
+	if err := tx.QueryRowContext(ctx, `SELECT latest_ip FROM user_info_table WHERE user_id = $1`, result.UserID).
+		Scan(scanAddr(&result.LatestIP)); err != nil {
+		return result, err
+	}
+	if result.Relays, err = relayTable(ctx, tx); err != nil {
+		return result, err
+	}
+	if len(req.CSR) != 0 {
+		if issuer == nil {
+			return result, errors.New("this control server issues no client certificates")
+		}
+		if result.Certificate, err = issuer.issue(req.CSR, req.Username); err != nil {
+			return result, err
+		}
+	}
+	result.Status = EnrollApproved
+	return result, nil
+}
+
+// checkEnrollTaken refuses a username or key that a user or a pending request already has,
+// removed users keep theirs reserved
+func checkEnrollTaken(ctx context.Context, tx *sql.Tx, username string, wgpubkey wgtypes.Key) error {
+	var taken bool
+	if err := tx.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM user_info_table WHERE username = $1 OR user_pubkey = $2)
+			OR EXISTS (SELECT 1 FROM enrollment_request_table
+				WHERE status = 'pending' AND (username = $1 OR user_pubkey = $2))`,
+		username, wgpubkey[:]).Scan(&taken); err != nil {
+		return err
+	}
+	if taken {
+		return errEnrollRefused{errors.New("username or public key already registered")}
+	}
+	return nil
+}
+
+// httpHandleEnroll serves /enroll: {token, username, pub_key, signing_key, csr} → EnrollResult.
+// The new client has no client certificate yet, the invite token is its credential; issuer
+// signs the csr into one. A csr the server cannot sign is refused before the invite is spent.
+// In approval mode the answer is a pending request, see RequestEnrollment.
+func httpHandleEnroll(db *sql.DB, ov overlay.Config, mode string, issuer *clientIssuer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		var req EnrollRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 8192)).Decode(&req); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		if len(req.CSR) != 0 && issuer == nil {
+			http.Error(w, "this control server issues no client certificates", http.StatusServiceUnavailable)
+			return
+		}
+
+		var result EnrollResult
+		var err error
+		if mode == EnrollmentApproval {
+			result, err = RequestEnrollment(db, req)
+		} else {
+			result, err = EnrollUser(db, req, issuer)
+		}
+		writeEnrollResult(w, result, err, ov)
+	}
+}
+
+// writeEnrollResult answers /enroll and /enroll/status, adding the overlay settings once approved
+func writeEnrollResult(w http.ResponseWriter, result EnrollResult, err error, ov overlay.Config) {
+	var refused errEnrollRefused
+	if errors.As(err, &refused) {
+		http.Error(w, refused.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Printf("enroll: %v", err)
+		http.Error(w, "enroll fail", http.StatusInternalServerError)
+		return
+	}
+	if result.Status == EnrollApproved {
+		result.OverlaySupernet, result.OverlayULA = ov.Supernet, ov.ULA
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
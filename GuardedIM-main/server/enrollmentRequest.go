@@ -0,0 +1,368 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"guardedim/overlay"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// EnrollmentRequest is a row of enrollment_request_table as gdim pending shows it
+type EnrollmentRequest struct {
+	RequestID   int64
+	Username    string
+	DisplayName string
+	PubKey      wgtypes.Key
+	Relay       string // name (or server_id) of the relay the invite homes the user on, empty if none
+	InvitedBy   string // username of the inviting user, empty for an admin invite
+	Status      string
+	Reason      string
+	CreatedAt   time.Time
+	UserID      int64 // the created user once approved
+}
+
+// RequestEnrollment is EnrollUser for approval mode: it redeems the invite and files a pending
+// request instead of creating the user. The answer carries the request_id and a secret the
+// client polls /enroll/status with.
+func RequestEnrollment(db *sql.DB, req EnrollRequest) (EnrollResult, error) {
+	req, wgpubkey, signkey, err := checkEnrollRequest(req)
+	if err != nil {
+		return EnrollResult{}, err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return EnrollResult{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// two requests for the same name race on the pending indexes, the loser is refused on its retry
+	var result EnrollResult
+	err = withRetry(ctx, db, func(tx *sql.Tx) error {
+		var err error
+		result, err = requestEnrollmentTx(ctx, tx, req, wgpubkey, signkey, secret)
+		return err
+	})
+	return result, err
+}
+
+func requestEnrollmentTx(ctx context.Context, tx *sql.Tx, req EnrollRequest, wgpubkey wgtypes.Key, signkey []byte, secret []byte) (EnrollResult, error) {
+	var result EnrollResult
+
+	claims, err := redeemInviteTx(ctx, tx, req.Token)
+	if err != nil {
+		return result, errEnrollRefused{err}
+	}
+	if err := checkEnrollTaken(ctx, tx, req.Username, wgpubkey); err != nil {
+		return result, err
+	}
+
+	var relay any
+	if claims.Relay != 0 {
+		relay = claims.Relay
+	}
+	var csr any
+	if len(req.CSR) != 0 {
+		csr = req.CSR
+	}
+	secret_hash := sha256.Sum256(secret)
+	if err := tx.QueryRowContext(ctx, `
+		INSERT INTO enrollment_request_table
+			(invite_id, secret_hash, username, display_name, user_pubkey, signing_pubkey, home_server_id, csr)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING request_id;`,
+		claims.ID, secret_hash[:], req.Username, req.DisplayName, wgpubkey[:], signkey, relay, csr).Scan(&result.RequestID); err != nil {
+		return result, err
+	}
+	result.Status = EnrollPending
+	result.Secret = base64.RawURLEncoding.EncodeToString(secret)
+	return result, nil
+}
+
+// enrollCollectWindow is how long the secret of an approved request keeps working after the
+// first answer that carried the result, so a client whose answer got lost can ask again
+const enrollCollectWindow = 15 * time.Minute
+
+// EnrollmentStatus tells a client how its request stands. Once approved the result is the
+// one EnrollUser would have given: the first such answer has issuer sign the stored CSR and
+// keeps the certificate, later ones repeat it until enrollCollectWindow has passed, then the
+// secret is spent. A user suspended or expired since gets nothing; a wrong secret looks like
+// an unknown request.
+func EnrollmentStatus(db *sql.DB, request_id int64, secret string, issuer *clientIssuer) (EnrollResult, error) {
+	result := EnrollResult{RequestID: request_id}
+	unknown := errEnrollRefused{errors.New("unknown enrollment request")}
+
+	raw, err := base64.RawURLEncoding.DecodeString(secret)
+	if err != nil {
+		return result, unknown
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	var stored []byte
+	var reason, username, csr, certificate sql.NullString
+	var user_id sql.NullInt64
+	var collected, spent bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT secret_hash, status, reason, user_id, username, csr, certificate,
+		       collected_at IS NOT NULL, COALESCE(collected_at < now() - $2 * INTERVAL '1 second', false)
+		FROM enrollment_request_table WHERE request_id = $1 FOR UPDATE`,
+		request_id, int64(enrollCollectWindow/time.Second)).
+		Scan(&stored, &result.Status, &reason, &user_id, &username, &csr, &certificate, &collected, &spent)
+	if errors.Is(err, sql.ErrNoRows) {
+		return result, unknown
+	}
+	if err != nil {
+		return result, err
+	}
+	secret_hash := sha256.Sum256(raw)
+	if subtle.ConstantTimeCompare(stored, secret_hash[:]) != 1 || spent {
+		return result, unknown
+	}
+	result.Reason = reason.String
+	if result.Status != EnrollApproved {
+		return result, nil
+	}
+
+	// the user may have been removed, suspended or expired since
+	var disabled, expired bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT user_id, latest_ip, disabled, COALESCE(expires_at <= now(), false)
+		FROM user_info_table WHERE user_id = $1 AND deleted_at IS NULL`,
+		user_id.Int64).Scan(&result.UserID, scanAddr(&result.LatestIP), &disabled, &expired)
+	if errors.Is(err, sql.ErrNoRows) {
+		return result, errEnrollRefused{errors.New("the enrolled user has been removed")}
+	}
+	if err != nil {
+		return result, err
+	}
+	if disabled || expired {
+		return result, errEnrollRefused{errors.New("the enrolled user is suspended or expired")}
+	}
+	if result.Relays, err = relayTable(ctx, tx); err != nil {
+		return result, err
+	}
+
+	if !collected {
+		if csr.Valid {
+			if issuer == nil {
+				return result, errors.New("this control server issues no client certificates")
+			}
+			cert, err := issuer.issue(csr.String, username.String)
+			if err != nil {
+				return result, err
+			}
+			certificate = sql.NullString{String: cert, Valid: true}
+		}
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE enrollment_request_table SET certificate = $1, csr = NULL, collected_at = now()
+			WHERE request_id = $2`, certificate, request_id); err != nil {
+			return result, fmt.Errorf("update enrollment request: %w", err)
+		}
+	}
+	result.Certificate = certificate.String
+	return result, tx.Commit()
+}
+
+// resolveEnrollment finds a pending request by numeric request_id or by the requested username
+func resolveEnrollment(ctx context.Context, q dbtx, request string) (int64, error) {
+	query := `SELECT request_id FROM enrollment_request_table WHERE username = $1 AND status = 'pending'`
+	var arg any = request
+	if id, err := strconv.ParseInt(request, 10, 64); err == nil {
+		query = `SELECT request_id FROM enrollment_request_table WHERE request_id = $1 AND status = 'pending'`
+		arg = id
+	}
+
+	var request_id int64
+	err := q.QueryRowContext(ctx, query, arg).Scan(&request_id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("no pending enrollment named or numbered %q", request)
+	}
+	return request_id, err
+}
+
+// ListEnrollments returns the pending requests, oldest first, or every request with all
+func ListEnrollments(db *sql.DB, all bool) ([]EnrollmentRequest, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT e.request_id, e.username, e.display_name, e.user_pubkey,
+		       COALESCE(s.server_name, e.home_server_id::STRING, ''), COALESCE(u.username, ''),
+		       e.status, COALESCE(e.reason, ''), e.created_at, COALESCE(e.user_id, 0)
+		FROM enrollment_request_table AS e
+		JOIN invite_table AS i ON i.invite_id = e.invite_id
+		LEFT JOIN server_info_table AS s ON s.server_id = e.home_server_id
+		LEFT JOIN user_info_table AS u ON u.user_id = i.issued_by
+		WHERE $1 OR e.status = 'pending'
+		ORDER BY e.created_at, e.request_id`, all)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var requests []EnrollmentRequest
+	for rows.Next() {
+		var r EnrollmentRequest
+		var pubkey []byte
+		if err := rows.Scan(&r.RequestID, &r.Username, &r.DisplayName, &pubkey, &r.Relay, &r.InvitedBy,
+			&r.Status, &r.Reason, &r.CreatedAt, &r.UserID); err != nil {
+			return nil, err
+		}
+		if r.PubKey, err = wgtypes.NewKey(pubkey); err != nil {
+			return nil, fmt.Errorf("request %d: %w", r.RequestID, err)
+		}
+		requests = append(requests, r)
+	}
+	return requests, rows.Err()
+}
+
+// ApproveEnrollment creates the user of a pending request, given by request_id or username,
+// the way AddUser does. relay and latest_ip may override the invite's relay and the allocated
+// address.
+// It does not contact the relays: a caller that wants the peer pushed now, as gdim pending
+// approve does, must call NotifyRelays afterwards, otherwise relays add it on their next reconciliation.
+func ApproveEnrollment(db *sql.DB, request string, relay string, latest_ip string) (int64, error) {
+	if len(request) == 0 {
+		return -2, errors.New("no enrollment request given")
+	}
+	var wanted_ip netip.Addr
+	var err error
+	if len(latest_ip) != 0 {
+		if wanted_ip, err = netip.ParseAddr(latest_ip); err != nil || !wanted_ip.Is4() {
+			return -8, errors.New("invalid user IP! please check")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var user_id int64
+	err = withRetry(ctx, db, func(tx *sql.Tx) error {
+		var err error
+		user_id, err = approveEnrollmentTx(ctx, tx, request, relay, wanted_ip)
+		return err
+	})
+	if err != nil && user_id >= 0 {
+		return -6, fmt.Errorf("commit user: %w", err)
+	}
+	return user_id, err
+}
+
+// approveEnrollmentTx is ApproveEnrollment inside the caller's transaction
+func approveEnrollmentTx(ctx context.Context, tx *sql.Tx, request string, relay string, wanted_ip netip.Addr) (int64, error) {
+	request_id, err := resolveEnrollment(ctx, tx, request)
+	if err != nil {
+		return -2, err
+	}
+	var invite_id, pubkey, signkey []byte
+	var username, display_name string
+	var home sql.NullInt64
+	if err := tx.QueryRowContext(ctx, `
+		SELECT invite_id, username, display_name, user_pubkey, signing_pubkey, home_server_id
+		FROM enrollment_request_table WHERE request_id = $1 FOR UPDATE`, request_id).
+		Scan(&invite_id, &username, &display_name, &pubkey, &signkey, &home); err != nil {
+		return -6, err
+	}
+	wgpubkey, err := wgtypes.NewKey(pubkey)
+	if err != nil {
+		return -1, errors.New("invalid public key")
+	}
+
+	// a user may have taken the name or key since the request was filed (adduser does not look at requests)
+	var taken bool
+	if err := tx.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM user_info_table WHERE username = $1 OR user_pubkey = $2)`,
+		username, pubkey).Scan(&taken); err != nil {
+		return -6, err
+	}
+	if taken {
+		return -11, errors.New("username or public key already registered, reject the request")
+	}
+
+	if len(relay) == 0 && home.Valid {
+		relay = strconv.FormatInt(home.Int64, 10)
+	}
+	user_id, err := insertUserTx(ctx, tx, username, display_name, wgpubkey, signkey, relay, wanted_ip, time.Time{})
+	if err != nil {
+		return user_id, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE enrollment_request_table SET status = 'approved', decided_at = now(), user_id = $1
+		WHERE request_id = $2`, user_id, request_id); err != nil {
+		return -6, fmt.Errorf("update enrollment request: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE invite_table SET redeemed_by = $1 WHERE invite_id = $2`,
+		user_id, invite_id); err != nil {
+		return -6, fmt.Errorf("update invite: %w", err)
+	}
+	return user_id, nil
+}
+
+// RejectEnrollment turns down a pending request, given by request_id or username. The invite
+// stays spent; reason is shown to the client when it polls.
+func RejectEnrollment(db *sql.DB, request string, reason string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	request_id, err := resolveEnrollment(ctx, db, request)
+	if err != nil {
+		return 0, err
+	}
+	var why any
+	if len(reason) != 0 {
+		why = reason
+	}
+	res, err := db.ExecContext(ctx, `
+		UPDATE enrollment_request_table SET status = 'rejected', decided_at = now(), reason = $1
+		WHERE request_id = $2 AND status = 'pending'`, why, request_id)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return 0, fmt.Errorf("enrollment request %d was decided meanwhile", request_id)
+	}
+	return request_id, nil
+}
+
+// httpHandleEnrollStatus serves /enroll/status: {request_id, secret} → EnrollResult.
+// Like /enroll it needs no client certificate, the secret from /enroll is the credential.
+func httpHandleEnrollStatus(db *sql.DB, ov overlay.Config, issuer *clientIssuer) http.HandlerFunc {
+	type request struct {
+		RequestID int64  `json:"request_id"`
+		Secret    string `json:"secret"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		var req request
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&req); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		result, err := EnrollmentStatus(db, req.RequestID, req.Secret, issuer)
+		writeEnrollResult(w, result, err, ov)
+	}
+}
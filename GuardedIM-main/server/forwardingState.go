@@ -0,0 +1,117 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// forwardingStateDir keeps the sysctl values enableForwarding replaced, one file per interface,
+// so TeardownWG0Linux puts them back whether gdimd or gdim stopserver runs it.
+// It lives on /run because the kernel forgets the settings on reboot as well.
+const forwardingStateDir = "/run/gdim"
+
+func forwardingStatePath(iface string) string {
+	return filepath.Join(forwardingStateDir, iface+".sysctl")
+}
+
+// readForwardingState parses a state file of "path value" lines
+func readForwardingState(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	state := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			state[fields[0]] = fields[1]
+		}
+	}
+	return state, nil
+}
+
+// otherForwardingStates merges the state files of every instance but iface's.
+// Host-wide settings such as ip_forward show up there while another gdimd still relies on them.
+func otherForwardingStates(iface string) (map[string]string, error) {
+	paths, err := filepath.Glob(filepath.Join(forwardingStateDir, "*.sysctl"))
+	if err != nil {
+		return nil, err
+	}
+	others := make(map[string]string)
+	for _, path := range paths {
+		if path == forwardingStatePath(iface) {
+			continue
+		}
+		state, err := readForwardingState(path)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range state {
+			others[k] = v
+		}
+	}
+	return others, nil
+}
+
+// saveForwarding records the current value of every setting before enableForwarding writes it.
+// A state file left by a run that never tore down still holds the values from before that run,
+// so it is kept. Another instance already changed the host-wide settings, so its record of
+// their original value is copied instead of the current one.
+func saveForwarding(iface string, paths []string) error {
+	state_path := forwardingStatePath(iface)
+	if _, err := os.Stat(state_path); err == nil {
+		return nil
+	}
+	others, err := otherForwardingStates(iface)
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	for _, path := range paths {
+		value, ok := others[path]
+		if !ok {
+			raw, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			value = strings.TrimSpace(string(raw))
+		}
+		fmt.Fprintf(&b, "%s %s\n", path, value)
+	}
+	if err := os.MkdirAll(forwardingStateDir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(state_path, []byte(b.String()), 0644)
+}
+
+// restoreForwarding writes back what saveForwarding recorded for iface. Host-wide settings
+// another running instance recorded as well are left to that instance. Settings of an
+// interface that is already gone are skipped.
+func restoreForwarding(iface string) error {
+	state_path := forwardingStatePath(iface)
+	state, err := readForwardingState(state_path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	others, err := otherForwardingStates(iface)
+	if err != nil {
+		return err
+	}
+
+	for path, value := range state {
+		if _, shared := others[path]; shared {
+			continue
+		}
+		if err := os.WriteFile(path, []byte(value), 0644); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("restore %s: %w", path, err)
+		}
+	}
+	return os.Remove(state_path)
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// addrScanner scans an INET column into a netip.Addr, NULL leaves the zero Addr
+type addrScanner struct{ dst *netip.Addr }
+
+// scanAddr is used like rows.Scan(scanAddr(&row.PrivIP))
+func scanAddr(dst *netip.Addr) sql.Scanner { return addrScanner{dst} }
+
+func (s addrScanner) Scan(src any) error {
+	if src == nil {
+		*s.dst = netip.Addr{}
+		return nil
+	}
+	text, err := inetText(src)
+	if err != nil {
+		return err
+	}
+	// a host address may come back as "10.0.1.5/32"
+	if prefix, err := netip.ParsePrefix(text); err == nil {
+		*s.dst = prefix.Addr()
+		return nil
+	}
+	addr, err := netip.ParseAddr(text)
+	if err != nil {
+		return fmt.Errorf("scan inet: %w", err)
+	}
+	*s.dst = addr
+	return nil
+}
+
+// prefixScanner scans an INET column holding a CIDR block into a netip.Prefix, NULL leaves the zero Prefix
+type prefixScanner struct{ dst *netip.Prefix }
+
+// scanPrefix is used like rows.Scan(scanPrefix(&row.Subnet))
+func scanPrefix(dst *netip.Prefix) sql.Scanner { return prefixScanner{dst} }
+
+func (s prefixScanner) Scan(src any) error {
+	if src == nil {
+		*s.dst = netip.Prefix{}
+		return nil
+	}
+	text, err := inetText(src)
+	if err != nil {
+		return err
+	}
+	prefix, err := netip.ParsePrefix(text)
+	if err != nil {
+		return fmt.Errorf("scan inet: %w", err)
+	}
+	*s.dst = prefix.Masked()
+	return nil
+}
+
+// inetText returns the text form pgx hands over for INET columns
+func inetText(src any) (string, error) {
+	switch v := src.(type) {
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	default:
+		return "", fmt.Errorf("scan inet: unsupported type %T", src)
+	}
+}
+
+// hostPrefix is the single-address prefix of addr, /32 or /128
+func hostPrefix(addr netip.Addr) netip.Prefix {
+	return netip.PrefixFrom(addr, addr.BitLen())
+}
+
+// ──────────── migration to INET ──────────────────────────────────────
+// Earlier versions stored server_pubip / server_privip as 16 raw bytes,
+// latest_ip as its text form in a BYTES column and server_subnet as STRING.
+
+// parseStoredAddr reads an address in either of the old encodings
+func parseStoredAddr(raw []byte) (string, error) {
+	if addr, err := netip.ParseAddr(string(raw)); err == nil {
+		return addr.String(), nil
+	}
+	if addr, ok := netip.AddrFromSlice(raw); ok {
+		return addr.Unmap().String(), nil
+	}
+	return "", fmt.Errorf("unreadable address %q", raw)
+}
+
+// parseStoredPrefix reads a relay subnet stored as CIDR text
+func parseStoredPrefix(raw []byte) (string, error) {
+	prefix, err := netip.ParsePrefix(string(raw))
+	if err != nil {
+		return "", err
+	}
+	return prefix.Masked().String(), nil
+}
+
+// columnType returns the information_schema data type of a column, "" if there is no such column
+func columnType(ctx context.Context, db *sql.DB, table string, column string) (string, error) {
+	var data_type string
+	err := db.QueryRowContext(ctx, `
+		SELECT data_type FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2`, table, column).Scan(&data_type)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return strings.ToLower(data_type), err
+}
+
+// convertColumnToINET replaces an address column by an INET column holding the same values.
+// The new column is filled next to the old one and renamed into place, so a run that stops
+// halfway picks up where it left off.
+func convertColumnToINET(ctx context.Context, db *sql.DB, table string, key string, column string, parse func([]byte) (string, error)) error {
+	tmp := column + "_inet"
+	typ, err := columnType(ctx, db, table, column)
+	if err != nil {
+		return err
+	}
+	if typ == "inet" {
+		return nil
+	}
+
+	if typ != "" {
+		if _, err := db.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s INET`, table, tmp)); err != nil {
+			return err
+		}
+
+		type pair struct {
+			key   int64
+			value string
+		}
+		rows, err := db.QueryContext(ctx, fmt.Sprintf(`SELECT %s, %s::BYTES FROM %s WHERE %s IS NOT NULL`, key, column, table, column))
+		if err != nil {
+			return err
+		}
+		var values []pair
+		for rows.Next() {
+			var k int64
+			var raw []byte
+			if err := rows.Scan(&k, &raw); err != nil {
+				rows.Close()
+				return err
+			}
+			v, err := parse(raw)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("%s.%s of %s %d: %w", table, column, key, k, err)
+			}
+			values = append(values, pair{k, v})
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, p := range values {
+			if _, err := db.ExecContext(ctx, fmt.Sprintf(`UPDATE %s SET %s = $1::INET WHERE %s = $2`, table, tmp, key), p.value, p.key); err != nil {
+				return err
+			}
+		}
+		if _, err := db.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE %s DROP COLUMN %s CASCADE`, table, column)); err != nil {
+			return err
+		}
+	}
+
+	_, err = db.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE %s RENAME COLUMN %s TO %s`, table, tmp, column))
+	return err
+}
+
+// migrateAddressesToINET is migration 7. Relays without a server_subnet get
+// the /24 around their private IP, which is what they were serving until now.
+func migrateAddressesToINET(ctx context.Context, db *sql.DB) error {
+	type column struct {
+		table, key, name string
+		parse            func([]byte) (string, error)
+	}
+	convert := func(columns ...column) error {
+		for _, c := range columns {
+			if err := convertColumnToINET(ctx, db, c.table, c.key, c.name, c.parse); err != nil {
+				return fmt.Errorf("convert %s.%s: %w", c.table, c.name, err)
+			}
+		}
+		return nil
+	}
+
+	if err := convert(
+		column{"server_info_table", "server_id", "server_pubip", parseStoredAddr},
+		column{"server_info_table", "server_id", "server_privip", parseStoredAddr},
+		column{"user_info_table", "user_id", "latest_ip", parseStoredAddr},
+	); err != nil {
+		return err
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT server_id, server_privip FROM server_info_table WHERE server_subnet IS NULL`)
+	if err != nil {
+		return err
+	}
+	legacy := make(map[int64]netip.Prefix)
+	for rows.Next() {
+		var id int64
+		var privip netip.Addr
+		if err := rows.Scan(&id, scanAddr(&privip)); err != nil {
+			rows.Close()
+			return err
+		}
+		if privip.Is4() {
+			legacy[id] = netip.PrefixFrom(privip, 24).Masked()
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for id, subnet := range legacy {
+		if _, err := db.ExecContext(ctx, `UPDATE server_info_table SET server_subnet = $1 WHERE server_id = $2`,
+			subnet.String(), id); err != nil {
+			return fmt.Errorf("fill in server_subnet of relay %d: %w", id, err)
+		}
+	}
+
+	return convert(column{"server_info_table", "server_id", "server_subnet", parseStoredPrefix})
+}
@@ -7,13 +7,29 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"guardedim/overlay"
+	"log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
-func InitializeControlServ(ctx context.Context, db *sql.DB, certDir string) error {
+// DefaultControlListen is the control server's address unless configured otherwise
+const DefaultControlListen = ":8089"
+
+// nonceStore selects where challenge nonces live, see NewNonceStore
+// listenAddr empty means DefaultControlListen, a second instance on the same host needs another port
+// ov is what /reconcile reconciles
+// enrollmentMode is EnrollmentOpen (or empty) or EnrollmentApproval, see httpHandleEnroll
+func InitializeControlServ(ctx context.Context, db *sql.DB, certDir string, nonceStore string, listenAddr string, ov overlay.Config, enrollmentMode string) error {
+	enrollmentMode, err := checkEnrollmentMode(enrollmentMode)
+	if err != nil {
+		return err
+	}
+
 	// --- TLS / mTLS setup ---
 	caPem, err := os.ReadFile(filepath.Join(certDir, "ca.crt"))
 	if err != nil {
@@ -24,6 +40,15 @@ func InitializeControlServ(ctx context.Context, db *sql.DB, certDir string) erro
 		return errors.New("failed to append CA cert")
 	}
 
+	// ca.key lets enrollment hand out client certificates
+	issuer, err := loadClientIssuer(certDir, caPem)
+	if err != nil {
+		return err
+	}
+	if issuer == nil {
+		log.Printf("control server: no ca.key in %s, enrolling clients get no client certificate", certDir)
+	}
+
 	serverCert, err := tls.LoadX509KeyPair(
 		filepath.Join(certDir, "node.crt"),
 		filepath.Join(certDir, "node.key"),
@@ -32,17 +57,35 @@ func InitializeControlServ(ctx context.Context, db *sql.DB, certDir string) erro
 		return fmt.Errorf("load server cert: %w", err)
 	}
 
-	// listen on all interfaces, port 8089
-	bind := ":8089"
+	// listen on all interfaces, port 8089 by default
+	bind := listenAddr
+	if bind == "" {
+		bind = DefaultControlListen
+	}
+
+	nonces, err := NewNonceStore(nonceStore, db)
+	if err != nil {
+		return err
+	}
+	go runNoncePurge(ctx, nonces, nonceTTL)
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/relay-table", httpHandleRelayTable(db))
-	mux.HandleFunc("/ip/replace", httpHandleReplaceIP(db))
+	mux.HandleFunc("/relay-table", requireClientCert(httpHandleRelayTable(db)))
+	mux.HandleFunc("/ip/replace", requireClientCert(httpHandleReplaceIP(db, nonces, ov, notifyAllRelays(db, certDir, bind))))
+	mux.HandleFunc("/identity/rotate", requireClientCert(httpHandleRotateSigningKey(db, nonces)))
+	mux.HandleFunc("/invite/create", requireClientCert(httpHandleCreateInvite(db, nonces)))
+	mux.HandleFunc("/reconcile", requireClientCert(httpHandleReconcile(db, ov)))
+	// new clients enroll before they have a certificate, the invite token vouches for them
+	mux.HandleFunc("/enroll", httpHandleEnroll(db, ov, enrollmentMode, issuer))
+	mux.HandleFunc("/enroll/status", httpHandleEnrollStatus(db, ov, issuer))
+	// gdim join fetches the CA here and checks it against the fingerprint in the invite link
+	mux.HandleFunc("/ca", httpHandleCA(caPem))
 
 	srvTLS := &tls.Config{
-		Certificates:             []tls.Certificate{serverCert},
-		ClientCAs:                caPool,
-		ClientAuth:               tls.RequireAndVerifyClientCert,
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    caPool,
+		// a certificate that is presented must verify, requireClientCert makes it mandatory per endpoint
+		ClientAuth:               tls.VerifyClientCertIfGiven,
 		MinVersion:               tls.VersionTLS13,
 		PreferServerCipherSuites: true,
 	}
@@ -67,4 +110,51 @@ func InitializeControlServ(ctx context.Context, db *sql.DB, certDir string) erro
 	return srv.ListenAndServeTLS("", "")
 }
 
+// notifyAllRelays returns a func that makes every relay, this one included, reconcile in the
+// background, so an address change reaches the peers' AllowedIPs right away.
+// The relays' control servers are expected on the port of bind.
+func notifyAllRelays(db *sql.DB, certDir string, bind string) func() {
+	_, port, err := net.SplitHostPort(bind)
+	if err != nil {
+		port = strings.TrimPrefix(DefaultControlListen, ":")
+	}
+	return func() {
+		go func() {
+			notices, err := NotifyRelays(db, certDir, port)
+			if err != nil {
+				log.Printf("control server: notify relays: %v", err)
+				return
+			}
+			for _, notice := range notices {
+				if len(notice.Error) != 0 {
+					log.Printf("control server: notify relays: %s", notice.Error)
+				}
+			}
+		}()
+	}
+}
+
+// httpHandleCA serves the CA certificate, it is public anyway
+func httpHandleCA(caPem []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		_, _ = w.Write(caPem)
+	}
+}
+
+// requireClientCert refuses requests that came without a verified client certificate
+func requireClientCert(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
 // NOTE: Update any invocations elsewhere to pass the context and certificate directory path.
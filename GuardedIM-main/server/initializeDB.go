@@ -6,24 +6,19 @@ import (
 	"time"
 )
 
-func InitializeDB(ctx context.Context, db *sql.DB) error {
-	// establish a bounded duration so DDL can’t hang forever
-	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
-	defer cancel()
-
-	// execute each DDL separately for clearer error reporting
-	serverInfoTableSQL := `
+// serverMigrations is the CockroachDB schema history, append new steps with the next version
+// and never edit one that has shipped
+var serverMigrations = []Migration{
+	{Version: 1, Name: "create server and user tables", Statements: []string{`
 		CREATE TABLE IF NOT EXISTS server_info_table (
 			server_id           BIGINT PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
 			server_name         STRING(64),
 			server_pubip        BYTES NOT NULL,
-			server_port			INT NOT NULL CHECK (server_port BETWEEN 0 AND 65535)
+			server_port         INT NOT NULL CHECK (server_port BETWEEN 0 AND 65535),
 			server_privip       BYTES NOT NULL UNIQUE,
 			server_pubkey       BYTES NOT NULL UNIQUE,
 			server_presharedkey BYTES NOT NULL
-		);`
-
-	userInfoTableSQL := `
+		);`, `
 		CREATE TABLE IF NOT EXISTS user_info_table (
 			user_id        BIGINT  PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
 			username       STRING(64)  NOT NULL UNIQUE,
@@ -32,12 +27,166 @@ func InitializeDB(ctx context.Context, db *sql.DB) error {
 			user_pubkey    BYTES   NOT NULL UNIQUE,
 			invite_history TIMESTAMPTZ[],
 			latest_ip      BYTES NOT NULL UNIQUE
-		);`
+		);`,
+	}},
+	// the reconciler's polling fallback watches updated_at
+	{Version: 2, Name: "add updated_at", Statements: []string{`
+		ALTER TABLE server_info_table
+			ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now() ON UPDATE now();`, `
+		ALTER TABLE user_info_table
+			ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now() ON UPDATE now();`,
+	}},
+	// ed25519 keys users sign control-plane requests with, kept apart from the WireGuard user_pubkey
+	// so they can be rotated on their own; revoked rows stay for auditing.
+	// At most one active signing key per user.
+	{Version: 3, Name: "create user_signing_key_table", Statements: []string{`
+		CREATE TABLE IF NOT EXISTS user_signing_key_table (
+			key_id         BIGINT PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
+			user_id        BIGINT NOT NULL REFERENCES user_info_table (user_id) ON DELETE CASCADE,
+			signing_pubkey BYTES  NOT NULL UNIQUE,
+			created_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+			revoked_at     TIMESTAMPTZ
+		);`, `
+		CREATE UNIQUE INDEX IF NOT EXISTS user_signing_key_active_idx
+			ON user_signing_key_table (user_id) WHERE revoked_at IS NULL;`,
+	}},
+	// pending challenge nonces shared by every relay when nonce_store is "database"
+	{Version: 4, Name: "create nonce_table", Statements: []string{`
+		CREATE TABLE IF NOT EXISTS nonce_table (
+			user_id    BIGINT PRIMARY KEY,
+			nonce      BYTES NOT NULL,
+			expires_at TIMESTAMPTZ NOT NULL
+		);`,
+	}},
+	// the relay a user is attached to, IPAM allocates latest_ip from that relay's subnet
+	{Version: 5, Name: "add user home_server_id", Statements: []string{`
+		ALTER TABLE user_info_table
+			ADD COLUMN IF NOT EXISTS home_server_id BIGINT REFERENCES server_info_table (server_id);`,
+	}},
+	// the CIDR block a relay owns inside the overlay supernet, AddServer refuses overlapping blocks;
+	// NULL on rows written before it existed means the /24 around server_privip
+	{Version: 6, Name: "add server_subnet", Statements: []string{`
+		ALTER TABLE server_info_table
+			ADD COLUMN IF NOT EXISTS server_subnet STRING UNIQUE;`,
+	}},
+	// typed addresses instead of raw or text bytes, so subnet membership is a CIDR
+	// containment query (<<, >>) and IPv6 needs no special casing
+	{Version: 7, Name: "store addresses as INET", Func: migrateAddressesToINET, Statements: []string{
+		`ALTER TABLE server_info_table ALTER COLUMN server_pubip SET NOT NULL;`,
+		`ALTER TABLE server_info_table ALTER COLUMN server_privip SET NOT NULL;`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS server_info_table_server_privip_key ON server_info_table (server_privip);`,
+		`ALTER TABLE server_info_table ALTER COLUMN server_subnet SET NOT NULL;`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS server_info_table_server_subnet_key ON server_info_table (server_subnet);`,
+		`ALTER TABLE user_info_table ALTER COLUMN latest_ip SET NOT NULL;`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS user_info_table_latest_ip_key ON user_info_table (latest_ip);`,
+	}},
+	// tombstones left by removeuser / removeserver --keep-history: the row stays for auditing,
+	// a removed user gives back its address (latest_ip NULL), a removed relay keeps its subnet reserved
+	{Version: 8, Name: "add deleted_at tombstones", Statements: []string{
+		`ALTER TABLE user_info_table ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;`,
+		`ALTER TABLE user_info_table ALTER COLUMN latest_ip DROP NOT NULL;`,
+		`ALTER TABLE server_info_table ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;`,
+	}},
+	// the ed25519 key every relay signs invite tokens with (a single row), and one row per
+	// issued invite so a token can be redeemed only once; issued_by NULL is an admin invite
+	{Version: 9, Name: "create invite tables", Statements: []string{`
+		CREATE TABLE IF NOT EXISTS invite_key_table (
+			key_id      INT PRIMARY KEY DEFAULT 1 CHECK (key_id = 1),
+			private_key BYTES NOT NULL,
+			created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+		);`, `
+		CREATE TABLE IF NOT EXISTS invite_table (
+			invite_id   BYTES PRIMARY KEY,
+			issued_by   BIGINT REFERENCES user_info_table (user_id) ON DELETE SET NULL,
+			created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+			expires_at  TIMESTAMPTZ NOT NULL,
+			redeemed_at TIMESTAMPTZ,
+			redeemed_by BIGINT REFERENCES user_info_table (user_id) ON DELETE SET NULL
+		);`,
+	}},
+	// enrollments waiting for an admin when enrollment_mode is "approval": the invite is spent
+	// when the request is filed, the user is created only on approval. The client polls with
+	// request_id and a secret, only its SHA-256 is kept. At most one pending request per
+	// username and per WireGuard key.
+	{Version: 10, Name: "create enrollment_request_table", Statements: []string{`
+		CREATE TABLE IF NOT EXISTS enrollment_request_table (
+			request_id     BIGINT PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
+			invite_id      BYTES NOT NULL REFERENCES invite_table (invite_id),
+			secret_hash    BYTES NOT NULL,
+			username       STRING(64)  NOT NULL,
+			display_name   STRING(128) NOT NULL,
+			user_pubkey    BYTES NOT NULL,
+			signing_pubkey BYTES NOT NULL,
+			home_server_id BIGINT REFERENCES server_info_table (server_id) ON DELETE SET NULL,
+			status         STRING NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'approved', 'rejected')),
+			reason         STRING,
+			created_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+			decided_at     TIMESTAMPTZ,
+			user_id        BIGINT REFERENCES user_info_table (user_id) ON DELETE SET NULL
+		);`, `
+		CREATE UNIQUE INDEX IF NOT EXISTS enrollment_request_pending_username_idx
+			ON enrollment_request_table (username) WHERE status = 'pending';`, `
+		CREATE UNIQUE INDEX IF NOT EXISTS enrollment_request_pending_pubkey_idx
+			ON enrollment_request_table (user_pubkey) WHERE status = 'pending';`,
+	}},
+	// the policy the relays' packet filter enforces, see acl.go: rules are matched by priority
+	// (lowest first) and rule_id, src and dst are selectors such as user:NAME or group:NAME,
+	// the port range applies to the destination port of tcp and udp. The single settings row
+	// holds the action for packets no rule matches, no row means allow.
+	{Version: 11, Name: "create acl tables", Statements: []string{`
+		CREATE TABLE IF NOT EXISTS acl_group_table (
+			group_id   BIGINT PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
+			group_name STRING(64) NOT NULL UNIQUE,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);`, `
+		CREATE TABLE IF NOT EXISTS acl_group_member_table (
+			group_id BIGINT NOT NULL REFERENCES acl_group_table (group_id) ON DELETE CASCADE,
+			user_id  BIGINT NOT NULL REFERENCES user_info_table (user_id) ON DELETE CASCADE,
+			PRIMARY KEY (group_id, user_id)
+		);`, `
+		CREATE TABLE IF NOT EXISTS acl_rule_table (
+			rule_id      BIGINT PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
+			priority     INT NOT NULL DEFAULT 100,
+			action       STRING NOT NULL CHECK (action IN ('allow', 'deny')),
+			src_selector STRING NOT NULL,
+			dst_selector STRING NOT NULL,
+			protocol     STRING NOT NULL DEFAULT 'any' CHECK (protocol IN ('any', 'tcp', 'udp', 'icmp')),
+			port_from    INT NOT NULL DEFAULT 0,
+			port_to      INT NOT NULL DEFAULT 65535,
+			description  STRING,
+			created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+			CHECK (port_from BETWEEN 0 AND 65535 AND port_to BETWEEN port_from AND 65535)
+		);`, `
+		CREATE TABLE IF NOT EXISTS acl_settings_table (
+			settings_id    INT PRIMARY KEY DEFAULT 1 CHECK (settings_id = 1),
+			default_action STRING NOT NULL DEFAULT 'allow' CHECK (default_action IN ('allow', 'deny')),
+			updated_at     TIMESTAMPTZ NOT NULL DEFAULT now() ON UPDATE now()
+		);`,
+	}},
+	// a suspended (disabled) or expired user keeps its row, address and keys, but relays drop
+	// its peer and the control server refuses its signed requests; expires_at NULL is never
+	{Version: 12, Name: "add user disabled and expires_at", Statements: []string{
+		`ALTER TABLE user_info_table ADD COLUMN IF NOT EXISTS disabled BOOL NOT NULL DEFAULT false;`,
+		`ALTER TABLE user_info_table ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;`,
+	}},
+	// the PEM certificate request of a pending enrollment, signed once it is approved
+	{Version: 13, Name: "add enrollment csr", Statements: []string{
+		`ALTER TABLE enrollment_request_table ADD COLUMN IF NOT EXISTS csr STRING;`,
+	}},
+	// the client certificate of an approved enrollment, issued on the first /enroll/status
+	// answer; collected_at starts the window in which the secret still fetches it
+	{Version: 14, Name: "add enrollment certificate and collected_at", Statements: []string{
+		`ALTER TABLE enrollment_request_table ADD COLUMN IF NOT EXISTS certificate STRING;`,
+		`ALTER TABLE enrollment_request_table ADD COLUMN IF NOT EXISTS collected_at TIMESTAMPTZ;`,
+	}},
+}
+
+// InitializeDB brings a fresh or existing database up to the latest schema version
+func InitializeDB(ctx context.Context, db *sql.DB) error {
+	// establish a bounded duration so DDL can’t hang forever
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
 
-	for _, q := range []string{serverInfoTableSQL, userInfoTableSQL} {
-		if _, err := db.ExecContext(ctx, q); err != nil {
-			return err
-		}
-	}
-	return nil
+	_, err := MigrateUp(ctx, db)
+	return err
 }
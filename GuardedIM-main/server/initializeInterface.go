@@ -1,17 +1,20 @@
 package server
 
 import (
-	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"net"
+	"guardedim/overlay"
+	"net/netip"
+	"os"
 	"strconv"
+	"strings"
 
 	"github.com/vishvananda/netlink"
 	"golang.org/x/sys/unix"
 	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/ipc"
 	"golang.zx2c4.com/wireguard/tun"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
@@ -19,8 +22,9 @@ import (
 // this function creates a wireguard interface inside user space
 // it utilizes system TUN functionality
 // can generate a new private key if not provided
+// the interface is named after iface and created with the TUN MTU mtu
 // return the created wireguard interface and error
-func createWG0(wg_privkey string, server_port string) (*device.Device, error) {
+func createWG0(iface string, mtu int, wg_privkey string, server_port string) (*device.Device, error) {
 
 	// declare the variables beforehand to prevent shadowing
 	var key wgtypes.Key
@@ -48,104 +52,208 @@ func createWG0(wg_privkey string, server_port string) (*device.Device, error) {
 	wg_privkey = hex.EncodeToString(key[:])
 
 	// create a TUN device first
-	tun_dev, err := tun.CreateTUN("wg0", 1500)
+	tun_dev, err := tun.CreateTUN(iface, mtu)
 	if err != nil {
 		return nil, err
 	}
 
 	bind := conn.NewDefaultBind()
-	logger := device.NewLogger(device.LogLevelVerbose, "wg0: ")
+	logger := device.NewLogger(device.LogLevelVerbose, iface+": ")
 
-	// create wireguard device
-	wg_dev := device.NewDevice(tun_dev, bind, logger)
+	// create wireguard device, packets from peers pass the ACL filter before reaching the host
+	wg_dev := device.NewDevice(newPacketFilter(tun_dev), bind, logger)
 	go wg_dev.RoutineTUNEventReader()
 
+	// expose the UAPI socket so wgctrl (UpdateConnection, gdim serverstatus) can reach the userspace device
+	uapi_file, err := ipc.UAPIOpen(iface)
+	if err != nil {
+		wg_dev.Close()
+		return nil, err
+	}
+	uapi, err := ipc.UAPIListen(iface, uapi_file)
+	if err != nil {
+		wg_dev.Close()
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := uapi.Accept()
+			if err != nil {
+				return
+			}
+			go wg_dev.IpcHandle(conn)
+		}
+	}()
+	go func() {
+		<-wg_dev.Wait()
+		uapi.Close()
+	}()
+
 	// generate the configuration
 	wg_config := fmt.Sprintf("private_key=%s\nlisten_port=%s", wg_privkey, server_port)
 
 	return wg_dev, wg_dev.IpcSet(wg_config)
 }
 
-// this function sets IP layer parameters under Linux environment and adds route for this new interface
-// needs private IP, but MTU can be set to zero to use the default value
+// this function sets IP layer parameters under Linux environment and adds routes for this new interface
+// needs the IPv4 private IP; interface name, MTU and the routed supernet come from ov
+// with a ULA prefix the relay also gets the matching IPv6 address and the prefix is routed into the interface too
 // return error
-func setupWG0Linux(server_privip string, MTU int) error {
+func setupWG0Linux(ov overlay.Config, server_privip string) error {
 
-	privip := net.ParseIP(server_privip)
-	var ip_net *net.IPNet
-	if privip == nil {
-		return errors.New("the given IP address is not valid")
+	privip, err := netip.ParseAddr(server_privip)
+	if err != nil || !privip.Is4() {
+		return errors.New("the given IP address is not a valid IPv4 address")
 	}
-	if v4 := privip.To4(); v4 != nil {
-		if v4[3] != 1 {
-			return errors.New("IPv4 server_privip must end with .1")
-		}
-		ip_net = &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}
-	} else {
-		ip16 := privip.To16()
-		if binary.BigEndian.Uint16(ip16[14:]) != 1 {
-			return errors.New("IPv6 server_privip must end with …:1")
-		}
-		ip_net = &net.IPNet{IP: ip16, Mask: net.CIDRMask(128, 128)}
+	// AddServer already placed the relay on the first host of its own subnet,
+	// which only ends in .1 for blocks of /24 and larger
+	if !ov.Supernet.Contains(privip) {
+		return fmt.Errorf("private IP %s is outside the overlay supernet %s", privip, ov.Supernet)
 	}
+	addrs := overlay.IPNets(ov.DualStack(privip)...)
 
-	if MTU == 0 {
-		MTU = 1500
+	link, err := netlink.LinkByName(ov.Interface)
+	if err != nil {
+		return err
 	}
 
-	if MTU > 1700 || MTU < 800 {
-		return errors.New("the MTU is either too large or too small")
+	// a previous run that was not torn down may have left the address behind
+	for i := range addrs {
+		addr := &netlink.Addr{IPNet: &addrs[i]}
+		if addrs[i].IP.To4() == nil {
+			// nobody else on a point-to-point TUN could hold the address, skip duplicate address detection
+			addr.Flags = unix.IFA_F_NODAD
+		}
+		if err := netlink.AddrAdd(link, addr); err != nil && !errors.Is(err, unix.EEXIST) {
+			return err
+		}
 	}
 
-	link, err := netlink.LinkByName("wg0")
-	if err != nil {
+	if err = netlink.LinkSetUp(link); err != nil {
 		return err
 	}
 
-	if err := netlink.AddrAdd(link, &netlink.Addr{IPNet: ip_net}); err != nil {
+	if err = netlink.LinkSetMTU(link, ov.MTU); err != nil {
 		return err
 	}
 
-	if err = netlink.LinkSetUp(link); err != nil {
-		return err
+	routes := ov.RouteIPNets()
+	for i := range routes {
+		route := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       &routes[i],
+		}
+		if err := netlink.RouteAdd(route); err != nil && !errors.Is(err, unix.EEXIST) {
+			return err
+		}
 	}
 
-	if err = netlink.LinkSetMTU(link, MTU); err != nil {
+	if err := enableForwarding(ov.Interface, ov.ULA.IsValid()); err != nil {
 		return err
 	}
+	return nil
 
-	route := &netlink.Route{
-		LinkIndex: link.Attrs().Index,
-		Dst:       &net.IPNet{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+}
+
+// this function lets the kernel forward packets that come in on iface back out of iface,
+// which is how user traffic crosses from one relay's subnet to another's
+// wireguard-go then picks the peer relay by its AllowedIPs
+// the previous values are recorded first, TeardownWG0Linux restores them
+// return error
+func enableForwarding(iface string, ipv6 bool) error {
+	settings := []struct{ path, value string }{
+		{"/proc/sys/net/ipv4/ip_forward", "1"},
+		// packets leave through the interface they arrived on, don't tell users to bypass the relay
+		{"/proc/sys/net/ipv4/conf/" + iface + "/send_redirects", "0"},
 	}
-	if err := netlink.RouteAdd(route); err != nil && !errors.Is(err, unix.EEXIST) {
-		return err
+	if ipv6 {
+		// a router ignores router advertisements unless accept_ra is 2, an uplink that
+		// autoconfigures would lose its address and default route once all/forwarding is on
+		uplinks, err := ipv6Uplinks()
+		if err != nil {
+			return fmt.Errorf("find IPv6 uplinks: %w", err)
+		}
+		for _, uplink := range uplinks {
+			path := "/proc/sys/net/ipv6/conf/" + uplink + "/accept_ra"
+			if raw, err := os.ReadFile(path); err == nil && strings.TrimSpace(string(raw)) == "1" {
+				settings = append(settings, struct{ path, value string }{path, "2"})
+			}
+		}
+		settings = append(settings, struct{ path, value string }{"/proc/sys/net/ipv6/conf/all/forwarding", "1"})
+	}
+	paths := make([]string, len(settings))
+	for i, s := range settings {
+		paths[i] = s.path
+	}
+	if err := saveForwarding(iface, paths); err != nil {
+		return fmt.Errorf("record forwarding settings: %w", err)
+	}
+	for _, s := range settings {
+		if err := os.WriteFile(s.path, []byte(s.value), 0644); err != nil {
+			return fmt.Errorf("enable forwarding: %w", err)
+		}
 	}
 	return nil
+}
 
+// this function names the interfaces that carry an IPv6 default route
+// return the interface names and error
+func ipv6Uplinks() ([]string, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V6)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[int]bool)
+	var names []string
+	add := func(index int) {
+		if index == 0 || seen[index] {
+			return
+		}
+		seen[index] = true
+		if link, err := netlink.LinkByIndex(index); err == nil {
+			names = append(names, link.Attrs().Name)
+		}
+	}
+	for _, route := range routes {
+		// the default route comes without Dst or as ::/0
+		if route.Dst != nil {
+			if ones, _ := route.Dst.Mask.Size(); ones != 0 {
+				continue
+			}
+		}
+		add(route.LinkIndex)
+		for _, hop := range route.MultiPath {
+			add(hop.LinkIndex)
+		}
+	}
+	return names, nil
 }
 
 // this function initializes the entire wireguard interface under Linux
+// ov names the interface and carries the overlay's supernet, ULA prefix and MTU
 // return the initialized wireguard device pointer
-func InitializeInterface(server_privip string, server_privkey string, server_port string, MTU int, db_access_url string) (*device.Device, error) {
+func InitializeInterface(ov overlay.Config, server_privip string, server_privkey string, server_port string, db_access_url string) (*device.Device, error) {
 	var wg_dev *device.Device
 	var err error
-	wg_dev, err = createWG0(server_privkey, server_port)
+	wg_dev, err = createWG0(ov.Interface, ov.MTU, server_privkey, server_port)
 	if err != nil {
 		return nil, err
 	}
-	err = setupWG0Linux(server_privip, MTU)
+	err = setupWG0Linux(ov, server_privip)
 	if err != nil {
+		wg_dev.Close()
 		return nil, err
 	}
 	db, err := OpenDBWithURL(db_access_url)
 	if err != nil {
 		fmt.Println("database connect failed!")
+		wg_dev.Close()
 		return nil, err
 	}
-	err = UpdateConnection(db)
+	_, err = UpdateConnection(db, ov)
 	if err != nil {
 		fmt.Println("initial connection update failed")
+		wg_dev.Close()
 		return nil, err
 	}
 	return wg_dev, nil
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultInviteTTL is how long an invite stays redeemable unless asked otherwise
+const DefaultInviteTTL = 24 * time.Hour
+
+// MaxInviteTTL caps the lifetime a user may ask for
+const MaxInviteTTL = 7 * 24 * time.Hour
+
+// a user may issue InviteRateLimit invites per InviteRateWindow, counted in invite_history
+const (
+	InviteRateLimit  = 5
+	InviteRateWindow = 24 * time.Hour
+)
+
+// ErrInviteRateLimited means the user issued too many invites recently
+var ErrInviteRateLimited = errors.New("invite rate limit reached, try again later")
+
+// Invite is an issued invite token
+type Invite struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// inviteClaims is the signed part of a token
+type inviteClaims struct {
+	ID       []byte `json:"id"`
+	IssuedBy int64  `json:"iss,omitempty"` // 0 for an admin invite
+	Relay    int64  `json:"relay,omitempty"`
+	Expires  int64  `json:"exp"` // unix seconds
+}
+
+// loadInviteKey returns the cluster-wide invite signing key, the first relay to need it creates it
+func loadInviteKey(ctx context.Context, q dbtx) (ed25519.PrivateKey, error) {
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, err
+	}
+	if _, err := q.ExecContext(ctx, `
+		INSERT INTO invite_key_table (key_id, private_key) VALUES (1, $1)
+		ON CONFLICT (key_id) DO NOTHING;`, seed); err != nil {
+		return nil, fmt.Errorf("store invite key: %w", err)
+	}
+	if err := q.QueryRowContext(ctx, `SELECT private_key FROM invite_key_table WHERE key_id = 1`).Scan(&seed); err != nil {
+		return nil, fmt.Errorf("read invite key: %w", err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.New("stored invite key is corrupt")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// token layout: base64url(claims JSON) "." base64url(ed25519 signature over the first part)
+func signInvite(key ed25519.PrivateKey, claims inviteClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	body := base64.RawURLEncoding.EncodeToString(payload)
+	sig := ed25519.Sign(key, []byte(body))
+	return body + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// parseInvite checks the token's signature and expiry, not whether it was redeemed already
+func parseInvite(pub ed25519.PublicKey, token string) (inviteClaims, error) {
+	var claims inviteClaims
+	body, sig_b64, ok := strings.Cut(strings.TrimSpace(token), ".")
+	if !ok {
+		return claims, errors.New("malformed invite")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(sig_b64)
+	if err != nil || !ed25519.Verify(pub, []byte(body), sig) {
+		return claims, errors.New("invalid invite signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return claims, errors.New("malformed invite")
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || len(claims.ID) == 0 {
+		return claims, errors.New("malformed invite")
+	}
+	if time.Now().Unix() >= claims.Expires {
+		return claims, errors.New("invite expired")
+	}
+	return claims, nil
+}
+
+// issueInviteTx records a new invite and signs its token.
+// issued_by 0 is an admin invite; a user's invites are rate limited through invite_history.
+// relay_id 0 leaves the home relay to enrollment (the only relay, or it has to be named).
+func issueInviteTx(ctx context.Context, tx *sql.Tx, issued_by int64, relay_id int64, ttl time.Duration) (Invite, error) {
+	var invite Invite
+	if ttl <= 0 {
+		ttl = DefaultInviteTTL
+	}
+	if ttl > MaxInviteTTL {
+		ttl = MaxInviteTTL
+	}
+
+	var issuer any
+	if issued_by != 0 {
+		issuer = issued_by
+		// keep only the timestamps still inside the window, then add this one
+		var issued int
+		if err := tx.QueryRowContext(ctx, `
+			UPDATE user_info_table
+			SET invite_history = array_append(
+				ARRAY(SELECT t FROM unnest(invite_history) AS t WHERE t > now() - $2 * INTERVAL '1 second'),
+				now())
+			WHERE user_id = $1 AND deleted_at IS NULL
+			RETURNING array_length(invite_history, 1)`,
+			issued_by, int64(InviteRateWindow/time.Second)).Scan(&issued); err != nil {
+			return invite, fmt.Errorf("record invite_history: %w", err)
+		}
+		if issued > InviteRateLimit {
+			return invite, ErrInviteRateLimited
+		}
+	}
+
+	key, err := loadInviteKey(ctx, tx)
+	if err != nil {
+		return invite, err
+	}
+	claims := inviteClaims{ID: make([]byte, 16), IssuedBy: issued_by, Relay: relay_id}
+	if _, err := rand.Read(claims.ID); err != nil {
+		return invite, err
+	}
+	invite.ExpiresAt = time.Now().Add(ttl).Truncate(time.Second)
+	claims.Expires = invite.ExpiresAt.Unix()
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO invite_table (invite_id, issued_by, expires_at) VALUES ($1, $2, $3);`,
+		claims.ID, issuer, invite.ExpiresAt); err != nil {
+		return invite, fmt.Errorf("insert invite: %w", err)
+	}
+	if invite.Token, err = signInvite(key, claims); err != nil {
+		return invite, err
+	}
+	return invite, nil
+}
+
+// CreateInvite issues an admin invite, relay (name or server_id) may be empty
+func CreateInvite(db *sql.DB, relay string, ttl time.Duration) (Invite, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Invite{}, err
+	}
+	defer tx.Rollback()
+
+	var relay_id int64
+	if len(relay) != 0 {
+		info, err := resolveRelay(ctx, tx, relay)
+		if err != nil {
+			return Invite{}, err
+		}
+		relay_id = info.ID
+	}
+	invite, err := issueInviteTx(ctx, tx, 0, relay_id, ttl)
+	if err != nil {
+		return invite, err
+	}
+	return invite, tx.Commit()
+}
+
+// redeemInviteTx checks a token and marks it used, so a second redemption fails
+func redeemInviteTx(ctx context.Context, tx *sql.Tx, token string) (inviteClaims, error) {
+	key, err := loadInviteKey(ctx, tx)
+	if err != nil {
+		return inviteClaims{}, err
+	}
+	claims, err := parseInvite(key.Public().(ed25519.PublicKey), token)
+	if err != nil {
+		return claims, err
+	}
+	res, err := tx.ExecContext(ctx, `
+		UPDATE invite_table SET redeemed_at = now()
+		WHERE invite_id = $1 AND redeemed_at IS NULL AND expires_at > now();`, claims.ID)
+	if err != nil {
+		return claims, err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return claims, errors.New("invite already used or revoked")
+	}
+	return claims, nil
+}
+
+// httpHandleCreateInvite lets an existing user invite someone:
+//   - Phase‑1 challenge:  client POSTs  {user_id, ttl_seconds}
+//     ↳ server returns   {nonce: "<hex>"}
+//   - Phase‑2 issue:     client POSTs  {user_id, ttl_seconds, sig}
+//     ↳ server returns   {token, expires_at}
+//
+// sig covers nonce‖"/invite/create"‖0‖ttl_seconds in decimal; the invitee is homed on the inviting user's relay.
+func httpHandleCreateInvite(db *sql.DB, nonces NonceStore) http.HandlerFunc {
+	type request struct {
+		UserID     uint64 `json:"user_id"`
+		TTLSeconds int64  `json:"ttl_seconds,omitempty"`
+		SigB64     string `json:"sig,omitempty"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		var req request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+
+		// ---- Phase 1: challenge ----
+		if req.SigB64 == "" {
+			issueChallenge(w, r, nonces, req.UserID)
+			return
+		}
+
+		// ---- Phase 2: verify signature ----
+		nonce, err := nonces.Consume(r.Context(), req.UserID)
+		if err != nil {
+			http.Error(w, "no nonce", http.StatusForbidden)
+			return
+		}
+		msg := signedMessage(nonce, "/invite/create", []byte(strconv.FormatInt(req.TTLSeconds, 10)))
+		if err := verifyUserSignature(r.Context(), db, req.UserID, msg, req.SigB64); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+		defer cancel()
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		home, err := userHomeRelay(ctx, tx, req.UserID)
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		invite, err := issueInviteTx(ctx, tx, int64(req.UserID), home.ID, time.Duration(req.TTLSeconds)*time.Second)
+		if errors.Is(err, ErrInviteRateLimited) {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		if err != nil || tx.Commit() != nil {
+			http.Error(w, "invite fail", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(invite)
+	}
+}
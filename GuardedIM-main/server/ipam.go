@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ErrSubnetFull means every host address of a relay's user subnet is in use
+var ErrSubnetFull = errors.New("no free address left in the relay's user subnet")
+
+// dbtx is what *sql.DB and *sql.Tx have in common
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// relayInfo is the part of a server_info_table row IPAM cares about
+type relayInfo struct {
+	ID     int64
+	Name   string
+	PrivIP netip.Addr
+	Subnet netip.Prefix
+}
+
+const relayInfoColumns = `server_id, server_name, server_privip, server_subnet`
+
+// scanRelayInfo reads a row selected with relayInfoColumns
+func scanRelayInfo(row interface{ Scan(...any) error }) (relayInfo, error) {
+	var info relayInfo
+	var name sql.NullString
+	err := row.Scan(&info.ID, &name, scanAddr(&info.PrivIP), scanPrefix(&info.Subnet))
+	info.Name = name.String
+	return info, err
+}
+
+// resolveRelay finds a relay by numeric server_id or by server_name
+func resolveRelay(ctx context.Context, q dbtx, relay string) (relayInfo, error) {
+	query := `SELECT ` + relayInfoColumns + ` FROM server_info_table WHERE server_name = $1 AND deleted_at IS NULL`
+	var arg any = relay
+	if id, err := strconv.ParseInt(relay, 10, 64); err == nil {
+		query = `SELECT ` + relayInfoColumns + ` FROM server_info_table WHERE server_id = $1 AND deleted_at IS NULL`
+		arg = id
+	}
+
+	info, err := scanRelayInfo(q.QueryRowContext(ctx, query, arg))
+	if errors.Is(err, sql.ErrNoRows) {
+		return info, fmt.Errorf("no relay named or numbered %q", relay)
+	}
+	return info, err
+}
+
+// relayForIP finds the relay whose user subnet holds ip, or the only relay when ip is the zero Addr
+func relayForIP(ctx context.Context, q dbtx, ip netip.Addr) (relayInfo, error) {
+	if ip.IsValid() {
+		info, err := scanRelayInfo(q.QueryRowContext(ctx,
+			`SELECT `+relayInfoColumns+` FROM server_info_table WHERE server_subnet >> $1 AND deleted_at IS NULL`, ip))
+		if errors.Is(err, sql.ErrNoRows) {
+			return info, fmt.Errorf("no relay serves %s", ip)
+		}
+		return info, err
+	}
+
+	rows, err := q.QueryContext(ctx, `SELECT `+relayInfoColumns+` FROM server_info_table WHERE deleted_at IS NULL LIMIT 2`)
+	if err != nil {
+		return relayInfo{}, err
+	}
+	defer rows.Close()
+
+	var all []relayInfo
+	for rows.Next() {
+		info, err := scanRelayInfo(rows)
+		if err != nil {
+			return relayInfo{}, err
+		}
+		all = append(all, info)
+	}
+	if err := rows.Err(); err != nil {
+		return relayInfo{}, err
+	}
+	if len(all) == 1 {
+		return all[0], nil
+	}
+	if len(all) == 0 {
+		return relayInfo{}, errors.New("no relay has been added yet")
+	}
+	return relayInfo{}, errors.New("several relays exist, choose one")
+}
+
+// isHostAddr tells whether ip is a host address of subnet: inside it and neither
+// the network nor the broadcast address. Callers also keep the relay's own address out.
+func isHostAddr(ip netip.Addr, subnet netip.Prefix) bool {
+	if !ip.Is4() || !subnet.Contains(ip) {
+		return false
+	}
+	host := v4ToUint32(ip) & (1<<(32-subnet.Bits()) - 1)
+	return host > 0 && host < 1<<(32-subnet.Bits())-1
+}
+
+// allocateUserIP returns the lowest free host address of the relay's user subnet.
+// Used addresses are read from user_info_table, so an address becomes available
+// again as soon as its user row is gone; nothing else has to be released.
+func allocateUserIP(ctx context.Context, q dbtx, relay relayInfo) (netip.Addr, error) {
+	rows, err := q.QueryContext(ctx, `SELECT latest_ip FROM user_info_table WHERE latest_ip << $1`, relay.Subnet)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer rows.Close()
+
+	used := make(map[netip.Addr]bool)
+	for rows.Next() {
+		var ip netip.Addr
+		if err := rows.Scan(scanAddr(&ip)); err != nil {
+			return netip.Addr{}, err
+		}
+		used[ip] = true
+	}
+	if err := rows.Err(); err != nil {
+		return netip.Addr{}, err
+	}
+
+	for ip := relay.Subnet.Addr().Next(); isHostAddr(ip, relay.Subnet); ip = ip.Next() {
+		if !used[ip] && ip != relay.PrivIP {
+			return ip, nil
+		}
+	}
+	return netip.Addr{}, ErrSubnetFull
+}
+
+// isRetryable reports CockroachDB serialization failures and unique violations,
+// which is how two concurrent allocations of the same address show up
+func isRetryable(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "40001" || pgErr.Code == "23505"
+	}
+	return false
+}
+
+// withRetry runs fn in a transaction on db and commits it. Two transactions claiming the same
+// free address or block collide on a unique index or fail to serialize; the loser runs fn
+// again, up to three more times, and then sees the address taken.
+func withRetry(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	for attempt := 0; ; attempt++ {
+		err := runTx(ctx, db, fn)
+		if err != nil && attempt < 3 && isRetryable(err) {
+			continue
+		}
+		return err
+	}
+}
+
+func runTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// isUniqueViolation reports an insert or update that hit a unique index
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+// UserOverlayIP returns the overlay address currently recorded for a user
+func UserOverlayIP(db *sql.DB, user_id int64) (string, error) {
+	var latest_ip netip.Addr
+	err := db.QueryRow(`SELECT latest_ip FROM user_info_table WHERE user_id = $1`, user_id).Scan(scanAddr(&latest_ip))
+	return latest_ip.String(), err
+}
+
+// userHomeRelay returns the user's home relay, the zero relayInfo for users without one
+func userHomeRelay(ctx context.Context, q dbtx, user_id uint64) (relayInfo, error) {
+	info, err := scanRelayInfo(q.QueryRowContext(ctx, `
+		SELECT s.server_id, s.server_name, s.server_privip, s.server_subnet
+		FROM user_info_table u JOIN server_info_table s ON s.server_id = u.home_server_id
+		WHERE u.user_id = $1 AND s.deleted_at IS NULL`, int64(user_id)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return relayInfo{}, nil
+	}
+	return info, err
+}
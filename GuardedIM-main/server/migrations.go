@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Migration is one versioned step of the CockroachDB schema.
+// Func, when set, runs before Statements for steps that need to move data around in Go.
+// Both must be idempotent (IF NOT EXISTS and the like): a run may stop between
+// executing them and recording the version, and deployments set up before migrations
+// existed already hold part of the schema.
+type Migration struct {
+	Version    int
+	Name       string
+	Func       func(ctx context.Context, db *sql.DB) error
+	Statements []string
+}
+
+// MigrationState tells whether a migration has been applied, AppliedAt is nil while it is pending
+type MigrationState struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+const schemaMigrationsSQL = `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INT PRIMARY KEY,
+		name       STRING NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);`
+
+// appliedMigrations reads schema_migrations, a database that never ran a migration has none
+func appliedMigrations(ctx context.Context, db *sql.DB) (map[int]MigrationState, error) {
+	applied := make(map[int]MigrationState)
+	rows, err := db.QueryContext(ctx, `SELECT version, name, applied_at FROM schema_migrations`)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "42P01" {
+			return applied, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var m MigrationState
+		var applied_at time.Time
+		if err := rows.Scan(&m.Version, &m.Name, &applied_at); err != nil {
+			return nil, err
+		}
+		m.AppliedAt = &applied_at
+		applied[m.Version] = m
+	}
+	return applied, rows.Err()
+}
+
+// MigrationStatus lists every known migration along with versions recorded by a newer gdim, oldest first
+func MigrationStatus(ctx context.Context, db *sql.DB) ([]MigrationState, error) {
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	var states []MigrationState
+	for _, m := range serverMigrations {
+		state := MigrationState{Version: m.Version, Name: m.Name}
+		if a, ok := applied[m.Version]; ok {
+			state.AppliedAt = a.AppliedAt
+			delete(applied, m.Version)
+		}
+		states = append(states, state)
+	}
+	for _, a := range applied {
+		states = append(states, a)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Version < states[j].Version })
+	return states, nil
+}
+
+// PendingMigrations returns the migrations MigrateUp would apply
+func PendingMigrations(ctx context.Context, db *sql.DB) ([]MigrationState, error) {
+	states, err := MigrationStatus(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	var pending []MigrationState
+	for _, s := range states {
+		if s.AppliedAt == nil {
+			pending = append(pending, s)
+		}
+	}
+	return pending, nil
+}
+
+// MigrateUp applies every pending migration in version order and records each one in schema_migrations.
+// Relays may run it at the same time, the statements are idempotent and recording a version twice is a no-op.
+// return the migrations applied by this call
+func MigrateUp(ctx context.Context, db *sql.DB) ([]MigrationState, error) {
+	if _, err := db.ExecContext(ctx, schemaMigrationsSQL); err != nil {
+		return nil, fmt.Errorf("create schema_migrations: %w", err)
+	}
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []MigrationState
+	for _, m := range serverMigrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		if m.Func != nil {
+			if err := m.Func(ctx, db); err != nil {
+				return done, fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+			}
+		}
+		for _, q := range m.Statements {
+			if _, err := db.ExecContext(ctx, q); err != nil {
+				return done, fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+			}
+		}
+		var applied_at time.Time
+		err := db.QueryRowContext(ctx, `
+			INSERT INTO schema_migrations (version, name) VALUES ($1, $2)
+			ON CONFLICT (version) DO UPDATE SET name = excluded.name
+			RETURNING applied_at`, m.Version, m.Name).Scan(&applied_at)
+		if err != nil {
+			return done, fmt.Errorf("record migration %d: %w", m.Version, err)
+		}
+		done = append(done, MigrationState{Version: m.Version, Name: m.Name, AppliedAt: &applied_at})
+	}
+	return done, nil
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrNoNonce means the user has no pending challenge, or it already expired or was used
+var ErrNoNonce = errors.New("no nonce")
+
+// NonceStore keeps the pending challenge nonce of each user.
+// Consume must be atomic: a nonce can be handed out at most once.
+type NonceStore interface {
+	// Put stores nonce for user_id, replacing any pending one
+	Put(ctx context.Context, user_id uint64, nonce []byte, ttl time.Duration) error
+	// Consume returns the pending, unexpired nonce of user_id and removes it
+	Consume(ctx context.Context, user_id uint64) ([]byte, error)
+	// Purge drops every expired nonce
+	Purge(ctx context.Context) error
+}
+
+// NewNonceStore picks the store implementation by name:
+// "memory" (default) keeps nonces in this process, "database" shares them between
+// every relay using the same CockroachDB cluster.
+func NewNonceStore(kind string, db *sql.DB) (NonceStore, error) {
+	switch kind {
+	case "", "memory":
+		return NewMemNonceStore(), nil
+	case "database":
+		return NewDBNonceStore(db), nil
+	default:
+		return nil, fmt.Errorf("unknown nonce store %q", kind)
+	}
+}
+
+// runNoncePurge purges store every interval until ctx is cancelled
+func runNoncePurge(ctx context.Context, store NonceStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := store.Purge(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("nonce purge failed: %v", err)
+		}
+	}
+}
+
+// nonceEntry holds the nonce bytes and expiry timestamp
+type nonceEntry struct {
+	val    []byte
+	expiry time.Time
+}
+
+// memNonceStore is map[user_id]nonceEntry guarded by a mutex
+type memNonceStore struct {
+	mu      sync.Mutex
+	entries map[uint64]nonceEntry
+}
+
+func NewMemNonceStore() NonceStore {
+	return &memNonceStore{entries: make(map[uint64]nonceEntry)}
+}
+
+func (s *memNonceStore) Put(_ context.Context, user_id uint64, nonce []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[user_id] = nonceEntry{val: nonce, expiry: time.Now().Add(ttl)}
+	return nil
+}
+
+func (s *memNonceStore) Consume(_ context.Context, user_id uint64) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[user_id]
+	delete(s.entries, user_id) // single-use, expired ones go too
+	if !ok || time.Now().After(entry.expiry) {
+		return nil, ErrNoNonce
+	}
+	return entry.val, nil
+}
+
+func (s *memNonceStore) Purge(_ context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for uid, entry := range s.entries {
+		if now.After(entry.expiry) {
+			delete(s.entries, uid)
+		}
+	}
+	return nil
+}
+
+// dbNonceStore keeps nonces in nonce_table so a challenge issued by one relay
+// can be answered at another. Expiry is judged by the database clock.
+type dbNonceStore struct {
+	db *sql.DB
+}
+
+func NewDBNonceStore(db *sql.DB) NonceStore {
+	return &dbNonceStore{db: db}
+}
+
+func (s *dbNonceStore) Put(ctx context.Context, user_id uint64, nonce []byte, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `
+		UPSERT INTO nonce_table (user_id, nonce, expires_at)
+		VALUES ($1, $2, now() + $3::INTERVAL);`, int64(user_id), nonce, ttl.String())
+	return err
+}
+
+func (s *dbNonceStore) Consume(ctx context.Context, user_id uint64) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	// DELETE … RETURNING is a single statement, so two relays can never both get the row
+	var nonce []byte
+	var expired bool
+	err := s.db.QueryRowContext(ctx, `
+		DELETE FROM nonce_table WHERE user_id = $1
+		RETURNING nonce, expires_at <= now();`, int64(user_id)).Scan(&nonce, &expired)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && expired) {
+		return nil, ErrNoNonce
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+func (s *dbNonceStore) Purge(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `DELETE FROM nonce_table WHERE expires_at <= now();`)
+	return err
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"guardedim/overlay"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RelayNotice is how one relay answered a NotifyRelays request
+type RelayNotice struct {
+	Relay   RelayTarget  `json:"relay"`
+	Addr    string       `json:"addr,omitempty"`
+	Changes *PeerChanges `json:"changes,omitempty"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// liveRelays lists every relay that is not tombstoned
+func liveRelays(ctx context.Context, q dbtx) ([]RelayTarget, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT server_id, server_name, server_privip, server_pubip
+		FROM server_info_table
+		WHERE deleted_at IS NULL`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var relays []RelayTarget
+	for rows.Next() {
+		var t RelayTarget
+		var name sql.NullString
+		if err := rows.Scan(&t.ServerID, &name, scanAddr(&t.PrivIP), scanAddr(&t.PubIP)); err != nil {
+			return nil, err
+		}
+		t.Name = name.String
+		relays = append(relays, t)
+	}
+	return relays, rows.Err()
+}
+
+// NotifyRelays asks every live relay, plus the extra ones (e.g. one that was just removed),
+// to reconcile its peers right away instead of waiting for its next reconciliation.
+// Each relay's control server is tried on its overlay address first, then on its public one,
+// at control_port, with the node certificate in certDir.
+// A relay that cannot be reached is reported in its RelayNotice, not as an error.
+func NotifyRelays(db *sql.DB, certDir string, control_port string, extra ...RelayTarget) ([]RelayNotice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	relays, err := liveRelays(ctx, db)
+	if err != nil {
+		return nil, fmt.Errorf("list relays: %w", err)
+	}
+	relays = append(relays, extra...)
+
+	httpClient, err := nodeHTTPClient(certDir, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	notices := make([]RelayNotice, len(relays))
+	var wg sync.WaitGroup
+	for i, relay := range relays {
+		wg.Add(1)
+		go func(i int, relay RelayTarget) {
+			defer wg.Done()
+			notices[i] = notifyRelay(ctx, httpClient, relay, control_port)
+		}(i, relay)
+	}
+	wg.Wait()
+	return notices, nil
+}
+
+// notifyRelay POSTs /reconcile to one relay, falling back from its overlay to its public address
+func notifyRelay(ctx context.Context, httpClient *http.Client, relay RelayTarget, control_port string) RelayNotice {
+	notice := RelayNotice{Relay: relay}
+	var errs []string
+	for _, ip := range []netip.Addr{relay.PrivIP, relay.PubIP} {
+		if !ip.IsValid() {
+			continue
+		}
+		notice.Addr = net.JoinHostPort(ip.String(), control_port)
+
+		var changes PeerChanges
+		err := postReconcile(ctx, httpClient, notice.Addr, &changes)
+		if err == nil {
+			notice.Changes = &changes
+			notice.Error = ""
+			return notice
+		}
+		errs = append(errs, err.Error())
+	}
+	notice.Error = strings.Join(errs, "; ")
+	return notice
+}
+
+func postReconcile(ctx context.Context, httpClient *http.Client, addr string, out *PeerChanges) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+addr+"/reconcile", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s: %s: %s", addr, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// httpHandleReconcile re-runs peer reconciliation on behalf of gdim on another relay
+// (removeuser, removeserver) and returns the PeerChanges.
+// Only node certificates may ask, users' client certificates are turned away.
+func httpHandleReconcile(db *sql.DB, ov overlay.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 || r.TLS.PeerCertificates[0].Subject.CommonName != "node" {
+			http.Error(w, "node certificate required", http.StatusForbidden)
+			return
+		}
+		changes, err := UpdateConnection(db, ov)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(changes)
+	}
+}
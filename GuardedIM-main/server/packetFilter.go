@@ -0,0 +1,316 @@
+package server
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// IP protocol numbers the filter looks into
+const (
+	protoICMP      = 1
+	protoTCP       = 6
+	protoUDP       = 17
+	protoFragment6 = 44
+	protoICMPv6    = 58
+)
+
+// how long a flow stays open without packets
+const (
+	tcpFlowIdle   = time.Hour
+	otherFlowIdle = 2 * time.Minute
+	// the rest of a fragmented packet must follow its first fragment within this, like the kernel's ipfrag_time
+	fragmentIdle = 30 * time.Second
+)
+
+// packetInfo is what the filter decides on
+type packetInfo struct {
+	protocol uint8
+	src, dst netip.Addr
+	// for tcp and udp the ports, for ICMP echo both carry the identifier
+	src_port, dst_port uint16
+	// a non-first fragment carries no ports, the first one has more_fragments set;
+	// id is the IPv4 identification or the IPv6 fragment header's
+	fragment       bool
+	more_fragments bool
+	id             uint32
+	// the start of the packet an ICMP error is about
+	inner *packetInfo
+}
+
+// parsePacket reads the IPv4 / IPv6 header and the ports behind it.
+// Of the IPv6 extension headers only the fragment header is followed, packets with others
+// only match protocol "any".
+func parsePacket(b []byte) (packetInfo, bool) {
+	return parseHeader(b, true)
+}
+
+// parseHeader is parsePacket; with errors it also reads the packet quoted in an ICMP error,
+// which is truncated and must not nest another one
+func parseHeader(b []byte, errors bool) (packetInfo, bool) {
+	var p packetInfo
+	var l4 []byte
+	if len(b) < 1 {
+		return p, false
+	}
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < 20 {
+			return p, false
+		}
+		ihl := int(b[0]&0x0f) * 4
+		if ihl < 20 || len(b) < ihl {
+			return p, false
+		}
+		p.protocol = b[9]
+		p.src = netip.AddrFrom4([4]byte(b[12:16]))
+		p.dst = netip.AddrFrom4([4]byte(b[16:20]))
+		p.id = uint32(binary.BigEndian.Uint16(b[4:6]))
+		flags := binary.BigEndian.Uint16(b[6:8])
+		if flags&0x1fff != 0 {
+			p.fragment = true
+			return p, true
+		}
+		p.more_fragments = flags&0x2000 != 0
+		l4 = b[ihl:]
+	case 6:
+		if len(b) < 40 {
+			return p, false
+		}
+		p.protocol = b[6]
+		p.src = netip.AddrFrom16([16]byte(b[8:24]))
+		p.dst = netip.AddrFrom16([16]byte(b[24:40]))
+		l4 = b[40:]
+		if p.protocol == protoFragment6 {
+			if len(l4) < 8 {
+				return p, false
+			}
+			p.protocol = l4[0]
+			p.id = binary.BigEndian.Uint32(l4[4:8])
+			offset := binary.BigEndian.Uint16(l4[2:4])
+			if offset>>3 != 0 {
+				p.fragment = true
+				return p, true
+			}
+			p.more_fragments = offset&1 != 0
+			l4 = l4[8:]
+		}
+	default:
+		return p, false
+	}
+
+	switch p.protocol {
+	case protoTCP, protoUDP:
+		if len(l4) < 4 {
+			return p, false
+		}
+		p.src_port = binary.BigEndian.Uint16(l4[0:2])
+		p.dst_port = binary.BigEndian.Uint16(l4[2:4])
+	case protoICMP, protoICMPv6:
+		if len(l4) < 8 {
+			return p, false
+		}
+		// echo request / reply: 8 / 0 for ICMP, 128 / 129 for ICMPv6
+		if t := l4[0]; t == 0 || t == 8 || t == 128 || t == 129 {
+			p.src_port = binary.BigEndian.Uint16(l4[4:6])
+			p.dst_port = p.src_port
+		}
+		if errors && isICMPError(p.protocol, l4[0]) {
+			if inner, ok := parseHeader(l4[8:], false); ok && !inner.fragment {
+				p.inner = &inner
+			}
+		}
+	}
+	return p, true
+}
+
+// isICMPError tells the ICMP types that quote the packet they are about: destination
+// unreachable (fragmentation needed among them), time exceeded and parameter problem,
+// for ICMPv6 also packet too big
+func isICMPError(protocol uint8, t uint8) bool {
+	if protocol == protoICMP {
+		return t == 3 || t == 11 || t == 12
+	}
+	return protocol == protoICMPv6 && t >= 1 && t <= 4
+}
+
+type flowKey struct {
+	protocol           uint8
+	src, dst           netip.Addr
+	src_port, dst_port uint16
+}
+
+type fragmentKey struct {
+	protocol uint8
+	src, dst netip.Addr
+	id       uint32
+}
+
+// flowTable remembers the flows the policy let through, so their replies pass as well,
+// and the fragmented packets whose first fragment passed, so the rest follows
+type flowTable struct {
+	mu         sync.Mutex
+	expires    map[flowKey]time.Time
+	fragments  map[fragmentKey]time.Time
+	last_purge time.Time
+}
+
+func (t *flowTable) track(p packetInfo, now time.Time) {
+	idle := otherFlowIdle
+	if p.protocol == protoTCP {
+		idle = tcpFlowIdle
+	}
+	key := flowKey{p.protocol, p.src, p.dst, p.src_port, p.dst_port}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.expires == nil {
+		t.expires = make(map[flowKey]time.Time)
+	}
+	t.expires[key] = now.Add(idle)
+	t.purge(now)
+}
+
+// purge drops what has expired, at most every otherFlowIdle; the caller holds mu
+func (t *flowTable) purge(now time.Time) {
+	if now.Sub(t.last_purge) <= otherFlowIdle {
+		return
+	}
+	for k, exp := range t.expires {
+		if now.After(exp) {
+			delete(t.expires, k)
+		}
+	}
+	for k, exp := range t.fragments {
+		if now.After(exp) {
+			delete(t.fragments, k)
+		}
+	}
+	t.last_purge = now
+}
+
+// trackFragments lets the remaining fragments of p, a first fragment, through
+func (t *flowTable) trackFragments(p packetInfo, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.fragments == nil {
+		t.fragments = make(map[fragmentKey]time.Time)
+	}
+	t.fragments[fragmentKey{p.protocol, p.src, p.dst, p.id}] = now.Add(fragmentIdle)
+	t.purge(now)
+}
+
+// fragmentAllowed tells whether p, a non-first fragment, belongs to a packet whose first fragment passed
+func (t *flowTable) fragmentAllowed(p packetInfo, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	exp, ok := t.fragments[fragmentKey{p.protocol, p.src, p.dst, p.id}]
+	return ok && now.Before(exp)
+}
+
+// isReply tells whether p answers a tracked flow
+func (t *flowTable) isReply(p packetInfo, now time.Time) bool {
+	return t.tracked(flowKey{p.protocol, p.dst, p.src, p.dst_port, p.src_port}, now)
+}
+
+// isRelatedError tells whether p is an ICMP error about a packet of a tracked flow, in either
+// direction, sent back to that packet's source. Path MTU discovery depends on these.
+func (t *flowTable) isRelatedError(p packetInfo, now time.Time) bool {
+	q := p.inner
+	if q == nil || p.dst != q.src {
+		return false
+	}
+	return t.tracked(flowKey{q.protocol, q.src, q.dst, q.src_port, q.dst_port}, now) || t.isReply(*q, now)
+}
+
+func (t *flowTable) tracked(key flowKey, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	exp, ok := t.expires[key]
+	return ok && now.Before(exp)
+}
+
+// packetFilter enforces currentACL on the relay's TUN device. Write carries what WireGuard
+// peers send into the host, that is where the policy applies; a packet relayed to another
+// peer comes back through Read, already checked. Packets the relay sends itself are not
+// filtered but tracked, so the answers reach it.
+type packetFilter struct {
+	tun.Device
+	flows flowTable
+}
+
+func newPacketFilter(dev tun.Device) *packetFilter {
+	return &packetFilter{Device: dev}
+}
+
+// allow decides one packet from a peer and tracks it when it passes
+func (f *packetFilter) allow(policy *aclPolicy, b []byte, now time.Time) bool {
+	p, ok := parsePacket(b)
+	if !ok {
+		return false
+	}
+	// a later fragment carries no ports, it follows the decision on its first fragment
+	if p.fragment {
+		return f.flows.fragmentAllowed(p, now)
+	}
+	if f.flows.isRelatedError(p, now) {
+		return true
+	}
+	if !f.flows.isReply(p, now) && !policy.allows(p) {
+		return false
+	}
+	f.flows.track(p, now)
+	if p.more_fragments {
+		f.flows.trackFragments(p, now)
+	}
+	return true
+}
+
+func (f *packetFilter) Write(bufs [][]byte, offset int) (int, error) {
+	policy := currentACL.Load()
+	if policy == nil || policy.open() {
+		return f.Device.Write(bufs, offset)
+	}
+	now := time.Now()
+	// only copy the batch once a packet is dropped
+	var kept [][]byte
+	for i, b := range bufs {
+		if f.allow(policy, b[offset:], now) {
+			if kept != nil {
+				kept = append(kept, b)
+			}
+			continue
+		}
+		if kept == nil {
+			kept = make([][]byte, i, len(bufs))
+			copy(kept, bufs[:i])
+		}
+	}
+	if kept == nil {
+		return f.Device.Write(bufs, offset)
+	}
+	dropped := len(bufs) - len(kept)
+	if len(kept) == 0 {
+		return dropped, nil
+	}
+	n, err := f.Device.Write(kept, offset)
+	return n + dropped, err
+}
+
+func (f *packetFilter) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	n, err := f.Device.Read(bufs, sizes, offset)
+	policy := currentACL.Load()
+	if policy == nil || policy.open() {
+		return n, err
+	}
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		if p, ok := parsePacket(bufs[i][offset : offset+sizes[i]]); ok && !p.fragment && policy.local.contains(p.src) {
+			f.flows.track(p, now)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,302 @@
+package server
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// ipv4Packet builds an IPv4 packet without options; frag is the flags / fragment offset field
+func ipv4Packet(protocol uint8, src string, dst string, id uint16, frag uint16, payload []byte) []byte {
+	b := make([]byte, 20, 20+len(payload))
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:4], uint16(20+len(payload)))
+	binary.BigEndian.PutUint16(b[4:6], id)
+	binary.BigEndian.PutUint16(b[6:8], frag)
+	b[8] = 64
+	b[9] = protocol
+	s, d := netip.MustParseAddr(src).As4(), netip.MustParseAddr(dst).As4()
+	copy(b[12:16], s[:])
+	copy(b[16:20], d[:])
+	return append(b, payload...)
+}
+
+func ipv6Packet(next uint8, src string, dst string, payload []byte) []byte {
+	b := make([]byte, 40, 40+len(payload))
+	b[0] = 0x60
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(payload)))
+	b[6] = next
+	b[7] = 64
+	s, d := netip.MustParseAddr(src).As16(), netip.MustParseAddr(dst).As16()
+	copy(b[8:24], s[:])
+	copy(b[24:40], d[:])
+	return append(b, payload...)
+}
+
+// fragment6 is an IPv6 fragment header followed by payload
+func fragment6(next uint8, offset uint16, more bool, id uint32, payload []byte) []byte {
+	b := make([]byte, 8, 8+len(payload))
+	b[0] = next
+	field := offset << 3
+	if more {
+		field |= 1
+	}
+	binary.BigEndian.PutUint16(b[2:4], field)
+	binary.BigEndian.PutUint32(b[4:8], id)
+	return append(b, payload...)
+}
+
+// l4Ports is the start of a tcp or udp header
+func l4Ports(src_port uint16, dst_port uint16) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint16(b[0:2], src_port)
+	binary.BigEndian.PutUint16(b[2:4], dst_port)
+	return b
+}
+
+// icmpMessage is an ICMP header; for echo rest starts with the identifier, for errors it is the quoted packet
+func icmpMessage(t uint8, id uint16, rest []byte) []byte {
+	b := make([]byte, 8, 8+len(rest))
+	b[0] = t
+	binary.BigEndian.PutUint16(b[4:6], id)
+	return append(b, rest...)
+}
+
+func TestParsePacket(t *testing.T) {
+	v4a, v4b := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	v6a, v6b := netip.MustParseAddr("fd00::1"), netip.MustParseAddr("fd00::2")
+	tcp := ipv4Packet(protoTCP, "10.0.0.1", "10.0.0.2", 7, 0, l4Ports(40000, 22))
+
+	badIHL := ipv4Packet(protoTCP, "10.0.0.1", "10.0.0.2", 7, 0, l4Ports(40000, 22))
+	badIHL[0] = 0x44
+	longIHL := ipv4Packet(protoTCP, "10.0.0.1", "10.0.0.2", 7, 0, nil)
+	longIHL[0] = 0x46
+
+	tests := []struct {
+		name  string
+		b     []byte
+		ok    bool
+		want  packetInfo
+		inner bool
+	}{
+		{name: "empty", b: nil},
+		{name: "unknown version", b: append([]byte{0x50}, make([]byte, 39)...)},
+		{name: "ipv4 short header", b: tcp[:19]},
+		{name: "ipv4 ihl below 5", b: badIHL},
+		{name: "ipv4 ihl beyond packet", b: longIHL},
+		{name: "ipv4 tcp without ports", b: tcp[:23]},
+		{name: "ipv4 tcp", b: tcp, ok: true,
+			want: packetInfo{protocol: protoTCP, src: v4a, dst: v4b, src_port: 40000, dst_port: 22, id: 7}},
+		{name: "ipv4 udp", b: ipv4Packet(protoUDP, "10.0.0.1", "10.0.0.2", 0, 0, l4Ports(5353, 53)), ok: true,
+			want: packetInfo{protocol: protoUDP, src: v4a, dst: v4b, src_port: 5353, dst_port: 53}},
+		{name: "ipv4 icmp truncated", b: ipv4Packet(protoICMP, "10.0.0.1", "10.0.0.2", 0, 0, make([]byte, 7))},
+		{name: "ipv4 icmp echo", b: ipv4Packet(protoICMP, "10.0.0.1", "10.0.0.2", 0, 0, icmpMessage(8, 99, nil)), ok: true,
+			want: packetInfo{protocol: protoICMP, src: v4a, dst: v4b, src_port: 99, dst_port: 99}},
+		{name: "ipv4 other protocol", b: ipv4Packet(47, "10.0.0.1", "10.0.0.2", 0, 0, nil), ok: true,
+			want: packetInfo{protocol: 47, src: v4a, dst: v4b}},
+		{name: "ipv4 first fragment", b: ipv4Packet(protoTCP, "10.0.0.1", "10.0.0.2", 7, 0x2000, l4Ports(40000, 22)), ok: true,
+			want: packetInfo{protocol: protoTCP, src: v4a, dst: v4b, src_port: 40000, dst_port: 22, id: 7, more_fragments: true}},
+		{name: "ipv4 later fragment", b: ipv4Packet(protoTCP, "10.0.0.1", "10.0.0.2", 7, 185, make([]byte, 2)), ok: true,
+			want: packetInfo{protocol: protoTCP, src: v4a, dst: v4b, id: 7, fragment: true}},
+		{name: "ipv4 icmp error", ok: true, inner: true,
+			b:    ipv4Packet(protoICMP, "10.0.0.2", "10.0.0.1", 0, 0, icmpMessage(3, 0, tcp[:28])),
+			want: packetInfo{protocol: protoICMP, src: v4b, dst: v4a}},
+		{name: "ipv4 icmp error quoting garbage", ok: true,
+			b:    ipv4Packet(protoICMP, "10.0.0.2", "10.0.0.1", 0, 0, icmpMessage(11, 0, tcp[:10])),
+			want: packetInfo{protocol: protoICMP, src: v4b, dst: v4a}},
+		{name: "ipv6 short header", b: ipv6Packet(protoTCP, "fd00::1", "fd00::2", nil)[:39]},
+		{name: "ipv6 tcp without ports", b: ipv6Packet(protoTCP, "fd00::1", "fd00::2", []byte{1, 2, 3})},
+		{name: "ipv6 tcp", b: ipv6Packet(protoTCP, "fd00::1", "fd00::2", l4Ports(40000, 443)), ok: true,
+			want: packetInfo{protocol: protoTCP, src: v6a, dst: v6b, src_port: 40000, dst_port: 443}},
+		{name: "ipv6 echo", b: ipv6Packet(protoICMPv6, "fd00::1", "fd00::2", icmpMessage(128, 5, nil)), ok: true,
+			want: packetInfo{protocol: protoICMPv6, src: v6a, dst: v6b, src_port: 5, dst_port: 5}},
+		{name: "ipv6 truncated fragment header", b: ipv6Packet(protoFragment6, "fd00::1", "fd00::2", make([]byte, 7))},
+		{name: "ipv6 first fragment", ok: true,
+			b:    ipv6Packet(protoFragment6, "fd00::1", "fd00::2", fragment6(protoUDP, 0, true, 1234, l4Ports(1, 2))),
+			want: packetInfo{protocol: protoUDP, src: v6a, dst: v6b, src_port: 1, dst_port: 2, id: 1234, more_fragments: true}},
+		{name: "ipv6 later fragment", ok: true,
+			b:    ipv6Packet(protoFragment6, "fd00::1", "fd00::2", fragment6(protoUDP, 160, false, 1234, nil)),
+			want: packetInfo{protocol: protoUDP, src: v6a, dst: v6b, id: 1234, fragment: true}},
+		{name: "ipv6 packet too big", ok: true, inner: true,
+			b: ipv6Packet(protoICMPv6, "fd00::2", "fd00::1", icmpMessage(2, 0,
+				ipv6Packet(protoTCP, "fd00::1", "fd00::2", l4Ports(40000, 443)))),
+			want: packetInfo{protocol: protoICMPv6, src: v6b, dst: v6a}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parsePacket(tt.b)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if (got.inner != nil) != tt.inner {
+				t.Fatalf("inner = %v, want one: %v", got.inner, tt.inner)
+			}
+			got.inner = nil
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFlowTable(t *testing.T) {
+	now := time.Now()
+	tcp := packetInfo{protocol: protoTCP, src: netip.MustParseAddr("10.0.0.1"), dst: netip.MustParseAddr("10.0.0.2"), src_port: 40000, dst_port: 22}
+	udp := packetInfo{protocol: protoUDP, src: tcp.src, dst: tcp.dst, src_port: 5353, dst_port: 53}
+	reverse := func(p packetInfo) packetInfo {
+		p.src, p.dst, p.src_port, p.dst_port = p.dst, p.src, p.dst_port, p.src_port
+		return p
+	}
+	otherPort := reverse(tcp)
+	otherPort.src_port = 23
+
+	var flows flowTable
+	flows.track(tcp, now)
+	flows.track(udp, now)
+
+	tests := []struct {
+		name string
+		p    packetInfo
+		at   time.Time
+		want bool
+	}{
+		{"tcp reply", reverse(tcp), now.Add(time.Minute), true},
+		{"tcp same direction", tcp, now.Add(time.Minute), false},
+		{"tcp reply from another port", otherPort, now.Add(time.Minute), false},
+		{"tcp reply before idle", reverse(tcp), now.Add(tcpFlowIdle - time.Second), true},
+		{"tcp reply after idle", reverse(tcp), now.Add(tcpFlowIdle), false},
+		{"udp reply", reverse(udp), now.Add(otherFlowIdle - time.Second), true},
+		{"udp reply after idle", reverse(udp), now.Add(otherFlowIdle), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := flows.isReply(tt.p, tt.at); got != tt.want {
+				t.Errorf("isReply = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// tracking again pushes the expiry out, purging drops what expired
+	flows.track(udp, now.Add(otherFlowIdle+time.Second))
+	if !flows.isReply(reverse(udp), now.Add(2*otherFlowIdle)) {
+		t.Error("refreshed udp flow expired")
+	}
+	if _, ok := flows.expires[flowKey{protoTCP, tcp.src, tcp.dst, tcp.src_port, tcp.dst_port}]; !ok {
+		t.Error("live tcp flow purged")
+	}
+}
+
+// testPolicy denies by default and allows tcp to port 22 of 10.0.0.2 / fd00::2
+func testPolicy() *aclPolicy {
+	rule := aclRule{allow: true, src: addrSet{any: true}, protocol: "tcp", port_lo: 22, port_hi: 22}
+	rule.dst.add(netip.MustParsePrefix("10.0.0.2/32"))
+	rule.dst.add(netip.MustParsePrefix("fd00::2/128"))
+	return &aclPolicy{rules: []aclRule{rule}}
+}
+
+// timedPacket is a packet arriving at after the start of a test
+type timedPacket struct {
+	b  []byte
+	at time.Duration
+}
+
+func TestFilterFragments(t *testing.T) {
+	now := time.Now()
+	payload := l4Ports(40000, 22)
+
+	tests := []struct {
+		name string
+		seq  []timedPacket
+		want bool // for the last packet of seq, the ones before must pass
+	}{
+		{name: "later fragment alone",
+			seq: []timedPacket{{ipv4Packet(protoTCP, "10.0.0.1", "10.0.0.2", 7, 185, nil), 0}}},
+		{name: "later fragment after allowed first", want: true,
+			seq: []timedPacket{
+				{ipv4Packet(protoTCP, "10.0.0.1", "10.0.0.2", 7, 0x2000, payload), 0},
+				{ipv4Packet(protoTCP, "10.0.0.1", "10.0.0.2", 7, 185, nil), time.Second}}},
+		{name: "later fragment with another id",
+			seq: []timedPacket{
+				{ipv4Packet(protoTCP, "10.0.0.1", "10.0.0.2", 7, 0x2000, payload), 0},
+				{ipv4Packet(protoTCP, "10.0.0.1", "10.0.0.2", 8, 185, nil), time.Second}}},
+		{name: "later fragment to another host",
+			seq: []timedPacket{
+				{ipv4Packet(protoTCP, "10.0.0.1", "10.0.0.2", 7, 0x2000, payload), 0},
+				{ipv4Packet(protoTCP, "10.0.0.1", "10.0.0.3", 7, 185, nil), time.Second}}},
+		{name: "later fragment too late",
+			seq: []timedPacket{
+				{ipv4Packet(protoTCP, "10.0.0.1", "10.0.0.2", 7, 0x2000, payload), 0},
+				{ipv4Packet(protoTCP, "10.0.0.1", "10.0.0.2", 7, 185, nil), fragmentIdle}}},
+		{name: "ipv6 later fragment after allowed first", want: true,
+			seq: []timedPacket{
+				{ipv6Packet(protoFragment6, "fd00::1", "fd00::2", fragment6(protoTCP, 0, true, 9, payload)), 0},
+				{ipv6Packet(protoFragment6, "fd00::1", "fd00::2", fragment6(protoTCP, 160, false, 9, nil)), time.Second}}},
+		{name: "ipv6 later fragment alone",
+			seq: []timedPacket{{ipv6Packet(protoFragment6, "fd00::1", "fd00::2", fragment6(protoTCP, 160, false, 9, nil)), 0}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newPacketFilter(nil)
+			policy := testPolicy()
+			last := len(tt.seq) - 1
+			for i, s := range tt.seq[:last] {
+				if !f.allow(policy, s.b, now.Add(s.at)) {
+					t.Fatalf("packet %d dropped", i)
+				}
+			}
+			if got := f.allow(policy, tt.seq[last].b, now.Add(tt.seq[last].at)); got != tt.want {
+				t.Errorf("allow = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// a first fragment the policy denies lets no later fragment through
+	f := newPacketFilter(nil)
+	if f.allow(testPolicy(), ipv4Packet(protoTCP, "10.0.0.1", "10.0.0.2", 7, 0x2000, l4Ports(40000, 80)), now) {
+		t.Fatal("first fragment to port 80 allowed")
+	}
+	if f.allow(testPolicy(), ipv4Packet(protoTCP, "10.0.0.1", "10.0.0.2", 7, 185, nil), now) {
+		t.Error("later fragment of a denied packet allowed")
+	}
+}
+
+func TestFilterICMPErrors(t *testing.T) {
+	now := time.Now()
+	request := ipv4Packet(protoTCP, "10.0.0.1", "10.0.0.2", 7, 0, l4Ports(40000, 22))
+	reply := ipv4Packet(protoTCP, "10.0.0.2", "10.0.0.1", 8, 0, l4Ports(22, 40000))
+	request6 := ipv6Packet(protoTCP, "fd00::1", "fd00::2", l4Ports(40000, 22))
+	other := ipv4Packet(protoTCP, "10.0.0.1", "10.0.0.2", 9, 0, l4Ports(40001, 22))
+
+	tests := []struct {
+		name string
+		b    []byte
+		want bool
+	}{
+		{"fragmentation needed for the request", ipv4Packet(protoICMP, "10.0.0.2", "10.0.0.1", 0, 0, icmpMessage(3, 0, request[:28])), true},
+		{"time exceeded for the request", ipv4Packet(protoICMP, "10.0.0.3", "10.0.0.1", 0, 0, icmpMessage(11, 0, request[:28])), true},
+		{"unreachable for the reply", ipv4Packet(protoICMP, "10.0.0.1", "10.0.0.2", 0, 0, icmpMessage(3, 0, reply[:28])), true},
+		{"unreachable sent elsewhere", ipv4Packet(protoICMP, "10.0.0.2", "10.0.0.3", 0, 0, icmpMessage(3, 0, request[:28])), false},
+		{"unreachable for an untracked flow", ipv4Packet(protoICMP, "10.0.0.2", "10.0.0.1", 0, 0, icmpMessage(3, 0, other[:28])), false},
+		{"echo request is no error", ipv4Packet(protoICMP, "10.0.0.2", "10.0.0.1", 0, 0, icmpMessage(8, 0, request[:28])), false},
+		{"packet too big for the request", ipv6Packet(protoICMPv6, "fd00::2", "fd00::1", icmpMessage(2, 0, request6[:48])), true},
+		{"packet too big sent elsewhere", ipv6Packet(protoICMPv6, "fd00::2", "fd00::3", icmpMessage(2, 0, request6[:48])), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newPacketFilter(nil)
+			policy := testPolicy()
+			for _, b := range [][]byte{request, reply, request6} {
+				if !f.allow(policy, b, now) {
+					t.Fatal("flow setup dropped")
+				}
+			}
+			if got := f.allow(policy, tt.b, now.Add(time.Second)); got != tt.want {
+				t.Errorf("allow = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"guardedim/overlay"
+	"log"
+	"time"
+)
+
+// DefaultReconcileInterval is how often gdimd re-applies the peer tables without any trigger
+const DefaultReconcileInterval = 60 * time.Second
+
+// DefaultChangePollInterval is how often the polling fallback checks the tables for changes
+const DefaultChangePollInterval = 5 * time.Second
+
+// RunReconciler keeps the overlay interface converged with the database until ctx is cancelled.
+// It reconciles every interval, and additionally whenever user_info_table,
+// server_info_table or the ACL tables change. Changes are picked up through a CockroachDB core
+// changefeed; if changefeeds are unavailable (kv.rangefeed.enabled is off) it
+// falls back to polling the updated_at columns every poll_interval.
+// ov names the interface and carries the overlay's addressing.
+func RunReconciler(ctx context.Context, db *sql.DB, interval time.Duration, poll_interval time.Duration, ov overlay.Config) error {
+	if interval <= 0 {
+		interval = DefaultReconcileInterval
+	}
+	if poll_interval <= 0 {
+		poll_interval = DefaultChangePollInterval
+	}
+
+	// buffered by one so a burst of changes collapses into a single reconciliation
+	trigger := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+
+	go func() {
+		err := watchChangefeed(ctx, db, notify)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("reconciler: changefeed unavailable (%v), polling every %s", err, poll_interval)
+		watchPolling(ctx, db, poll_interval, notify)
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case <-trigger:
+		}
+
+		changes, err := UpdateConnection(db, ov)
+		if err != nil {
+			log.Printf("reconciler: update connection failed: %v", err)
+			continue
+		}
+		if n := len(changes.Added) + len(changes.Changed) + len(changes.Removed); n > 0 {
+			log.Printf("reconciler: %d added, %d changed, %d removed",
+				len(changes.Added), len(changes.Changed), len(changes.Removed))
+		}
+	}
+}
+
+// watchChangefeed streams a core changefeed over both peer tables and calls notify on every row.
+// It only returns on error or when ctx is cancelled.
+func watchChangefeed(ctx context.Context, db *sql.DB, notify func()) error {
+	rows, err := db.QueryContext(ctx,
+		`EXPERIMENTAL CHANGEFEED FOR user_info_table, server_info_table,
+			acl_rule_table, acl_group_member_table, acl_settings_table WITH no_initial_scan`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var table sql.NullString
+		var key, value []byte
+		if err := rows.Scan(&table, &key, &value); err != nil {
+			return fmt.Errorf("scan changefeed row: %w", err)
+		}
+		notify()
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("changefeed closed")
+}
+
+// watchPolling compares a fingerprint of both peer tables every poll_interval and calls notify when it moves.
+// Row counts catch deletions, max(updated_at) catches inserts and updates. Rules are never updated
+// in place, so their count and max(rule_id) do for acl_rule_table.
+func watchPolling(ctx context.Context, db *sql.DB, poll_interval time.Duration, notify func()) {
+	const fingerprint_sql = `
+		SELECT (SELECT count(*) FROM user_info_table),
+		       (SELECT max(updated_at) FROM user_info_table),
+		       (SELECT count(*) FROM server_info_table),
+		       (SELECT max(updated_at) FROM server_info_table),
+		       (SELECT count(*) FROM acl_rule_table),
+		       (SELECT COALESCE(max(rule_id), 0) FROM acl_rule_table),
+		       (SELECT count(*) FROM acl_group_member_table),
+		       (SELECT max(updated_at) FROM acl_settings_table);`
+
+	var last string
+	ticker := time.NewTicker(poll_interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		qctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		var user_count, server_count, rule_count, rule_max, member_count int64
+		var user_updated, server_updated, acl_updated sql.NullTime
+		err := db.QueryRowContext(qctx, fingerprint_sql).
+			Scan(&user_count, &user_updated, &server_count, &server_updated,
+				&rule_count, &rule_max, &member_count, &acl_updated)
+		cancel()
+		if err != nil {
+			log.Printf("reconciler: poll failed: %v", err)
+			continue
+		}
+
+		fingerprint := fmt.Sprintf("%d/%d/%d/%d/%d/%d/%d/%d", user_count, user_updated.Time.UnixNano(),
+			server_count, server_updated.Time.UnixNano(), rule_count, rule_max, member_count, acl_updated.Time.UnixNano())
+		if last != "" && fingerprint != last {
+			notify()
+		}
+		last = fingerprint
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// RelayTarget is what it takes to reach a relay's control server
+type RelayTarget struct {
+	ServerID int64      `json:"server_id"`
+	Name     string     `json:"server_name"`
+	PrivIP   netip.Addr `json:"priv_ip"`
+	PubIP    netip.Addr `json:"pub_ip"`
+}
+
+// RemoveServer deletes a relay, given by server_name or server_id.
+// With keep_history the row stays as a tombstone instead (deleted_at set), keeping its
+// subnet, address and key reserved so they are never handed to another relay.
+// A relay that still has users homed on it is refused, move or remove them first.
+// The removed relay is returned so it can be told to drop its peers, see NotifyRelays.
+func RemoveServer(db *sql.DB, relay string, keep_history bool) (RelayTarget, error) {
+	var target RelayTarget
+	if len(relay) == 0 {
+		return target, fmt.Errorf("no relay given")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return target, err
+	}
+	defer tx.Rollback()
+
+	info, err := resolveRelay(ctx, tx, relay)
+	if err != nil {
+		return target, err
+	}
+	target = RelayTarget{ServerID: info.ID, Name: info.Name, PrivIP: info.PrivIP}
+	if err := tx.QueryRowContext(ctx, `SELECT server_pubip FROM server_info_table WHERE server_id = $1`, info.ID).
+		Scan(scanAddr(&target.PubIP)); err != nil {
+		return target, err
+	}
+
+	// users from before home_server_id count when their address sits in the relay's subnet
+	var homed int
+	if err := tx.QueryRowContext(ctx, `
+		SELECT count(*) FROM user_info_table
+		WHERE deleted_at IS NULL
+		  AND (home_server_id = $1 OR (home_server_id IS NULL AND latest_ip << $2))`,
+		info.ID, info.Subnet).Scan(&homed); err != nil {
+		return target, err
+	}
+	if homed > 0 {
+		return target, fmt.Errorf("relay %d still serves %d user(s), move or remove them first", info.ID, homed)
+	}
+
+	if keep_history {
+		if _, err := tx.ExecContext(ctx, `UPDATE server_info_table SET deleted_at = now() WHERE server_id = $1;`, info.ID); err != nil {
+			return target, fmt.Errorf("tombstone relay: %w", err)
+		}
+	} else {
+		// only tombstoned users can still point here
+		if _, err := tx.ExecContext(ctx, `UPDATE user_info_table SET home_server_id = NULL WHERE home_server_id = $1;`, info.ID); err != nil {
+			return target, fmt.Errorf("detach removed users: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM server_info_table WHERE server_id = $1;`, info.ID); err != nil {
+			return target, fmt.Errorf("delete relay: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return target, fmt.Errorf("commit relay removal: %w", err)
+	}
+	return target, nil
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// resolveUser finds a live user by numeric user_id or by username
+func resolveUser(ctx context.Context, q dbtx, user string) (int64, error) {
+	query := `SELECT user_id FROM user_info_table WHERE username = $1 AND deleted_at IS NULL`
+	var arg any = user
+	if id, err := strconv.ParseInt(user, 10, 64); err == nil {
+		query = `SELECT user_id FROM user_info_table WHERE user_id = $1 AND deleted_at IS NULL`
+		arg = id
+	}
+
+	var user_id int64
+	err := q.QueryRowContext(ctx, query, arg).Scan(&user_id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("no user named or numbered %q", user)
+	}
+	return user_id, err
+}
+
+// RemoveUser deletes a user, given by username or user_id, together with its signing keys.
+// With keep_history the row stays as a tombstone instead: deleted_at is set, the overlay
+// address is given back (latest_ip NULL) and the signing keys are revoked, while the
+// username and WireGuard key stay reserved.
+// Running relays only drop the peer once they reconcile, see NotifyRelays.
+func RemoveUser(db *sql.DB, user string, keep_history bool) (int64, error) {
+	if len(user) == 0 {
+		return -1, errors.New("no user given")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return -6, err
+	}
+	defer tx.Rollback()
+
+	user_id, err := resolveUser(ctx, tx, user)
+	if err != nil {
+		return -2, err
+	}
+
+	if keep_history {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE user_info_table SET deleted_at = now(), latest_ip = NULL
+			WHERE user_id = $1;`, user_id); err != nil {
+			return -6, fmt.Errorf("tombstone user: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE user_signing_key_table SET revoked_at = now()
+			WHERE user_id = $1 AND revoked_at IS NULL;`, user_id); err != nil {
+			return -6, fmt.Errorf("revoke signing keys: %w", err)
+		}
+	} else {
+		// user_signing_key_table follows through ON DELETE CASCADE
+		if _, err := tx.ExecContext(ctx, `DELETE FROM user_info_table WHERE user_id = $1;`, user_id); err != nil {
+			return -6, fmt.Errorf("delete user: %w", err)
+		}
+	}
+	// a challenge issued before the removal must not be answerable afterwards
+	if _, err := tx.ExecContext(ctx, `DELETE FROM nonce_table WHERE user_id = $1;`, user_id); err != nil {
+		return -6, fmt.Errorf("delete nonce: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return -6, fmt.Errorf("commit user removal: %w", err)
+	}
+	return user_id, nil
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl"
+)
+
+// ComponentStatus is the health of a single part of the relay
+type ComponentStatus struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// PeerStatus is a wireguard peer as reported by wgctrl
+type PeerStatus struct {
+	PublicKey     string    `json:"public_key"`
+	Endpoint      string    `json:"endpoint,omitempty"`
+	AllowedIPs    []string  `json:"allowed_ips"`
+	LastHandshake time.Time `json:"last_handshake"`
+	// seconds since the last handshake, -1 if the peer never completed one
+	HandshakeAge float64 `json:"handshake_age_seconds"`
+	RxBytes      int64   `json:"rx_bytes"`
+	TxBytes      int64   `json:"tx_bytes"`
+}
+
+// ServerStatus collects everything `gdim serverstatus` reports
+type ServerStatus struct {
+	Daemon      ComponentStatus `json:"daemon"`
+	WireGuard   ComponentStatus `json:"wireguard"`
+	Peers       []PeerStatus    `json:"peers"`
+	Database    ComponentStatus `json:"database"`
+	ControlServ ComponentStatus `json:"control_server"`
+}
+
+// WireGuardStatus reads the peers of the given interface through wgctrl
+func WireGuardStatus(iface string) ([]PeerStatus, error) {
+	client, err := wgctrl.New()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	wg_dev, err := client.Device(iface)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	peers := make([]PeerStatus, 0, len(wg_dev.Peers))
+	for _, p := range wg_dev.Peers {
+		ps := PeerStatus{
+			PublicKey:     p.PublicKey.String(),
+			LastHandshake: p.LastHandshakeTime,
+			HandshakeAge:  -1,
+			RxBytes:       p.ReceiveBytes,
+			TxBytes:       p.TransmitBytes,
+		}
+		if p.Endpoint != nil {
+			ps.Endpoint = p.Endpoint.String()
+		}
+		for _, a := range p.AllowedIPs {
+			ps.AllowedIPs = append(ps.AllowedIPs, a.String())
+		}
+		if !p.LastHandshakeTime.IsZero() {
+			ps.HandshakeAge = now.Sub(p.LastHandshakeTime).Seconds()
+		}
+		peers = append(peers, ps)
+	}
+	return peers, nil
+}
+
+// DBStatus pings the database pool and returns the round trip time
+func DBStatus(db *sql.DB) (time.Duration, error) {
+	if db == nil {
+		return 0, errors.New("no database connection")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	if err := db.PingContext(ctx); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// nodeHTTPClient builds an mTLS client for other relays' control servers,
+// the node certificate in certDir doubles as the client certificate
+func nodeHTTPClient(certDir string, timeout time.Duration) (*http.Client, error) {
+	caPem, err := os.ReadFile(filepath.Join(certDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("read ca: %w", err)
+	}
+	caPool := x509.NewCertPool()
+	if !caPool.AppendCertsFromPEM(caPem) {
+		return nil, errors.New("failed to append CA cert")
+	}
+	clientCert, err := tls.LoadX509KeyPair(
+		filepath.Join(certDir, "node.crt"),
+		filepath.Join(certDir, "node.key"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("load client cert: %w", err)
+	}
+
+	// ServerName is left empty so every request verifies the host it dials
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				Certificates: []tls.Certificate{clientCert},
+				RootCAs:      caPool,
+				MinVersion:   tls.VersionTLS13,
+			},
+		},
+	}, nil
+}
+
+// ControlServStatus performs an mTLS request against the control server's /relay-table
+// the node certificate in certDir doubles as the client certificate
+func ControlServStatus(addr string, certDir string) error {
+	httpClient, err := nodeHTTPClient(certDir, 3*time.Second)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Get("https://" + addr + "/relay-table")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
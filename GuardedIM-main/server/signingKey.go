@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// parseSigningKey decodes a base64 ed25519 public key as printed by `gdim showkey`
+func parseSigningKey(signing_pubkey string) (ed25519.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(signing_pubkey)
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid signing key")
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// setSigningKeyTx retires the user's active signing key (if any) and records the new one
+func setSigningKeyTx(ctx context.Context, tx *sql.Tx, user_id int64, key ed25519.PublicKey) error {
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE user_signing_key_table SET revoked_at = now()
+		WHERE user_id = $1 AND revoked_at IS NULL;`, user_id); err != nil {
+		return fmt.Errorf("revoke old signing key: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO user_signing_key_table (user_id, signing_pubkey)
+		VALUES ($1, $2);`, user_id, []byte(key)); err != nil {
+		return fmt.Errorf("insert signing key: %w", err)
+	}
+	return nil
+}
+
+// SetUserSigningKey registers (or replaces) the ed25519 key a user signs control-plane requests with
+func SetUserSigningKey(db *sql.DB, username string, signing_pubkey string) error {
+	key, err := parseSigningKey(signing_pubkey)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var user_id int64
+	if err := tx.QueryRowContext(ctx, `SELECT user_id FROM user_info_table WHERE username = $1 AND deleted_at IS NULL`, username).
+		Scan(&user_id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New("no such user")
+		}
+		return err
+	}
+	if err := setSigningKeyTx(ctx, tx, user_id, key); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// signedMessage is what a signed control-plane request covers: the challenge nonce, the
+// endpoint and the request's parameters, so a signature answers one challenge for one request
+func signedMessage(nonce []byte, path string, payload []byte) []byte {
+	msg := make([]byte, 0, len(nonce)+len(path)+1+len(payload))
+	msg = append(msg, nonce...)
+	msg = append(msg, path...)
+	msg = append(msg, 0)
+	return append(msg, payload...)
+}
+
+// verifyUserSignature checks sigB64 over msg against the user's active signing key.
+// Every signed control-plane request goes through here, so it also turns away suspended
+// and expired users (after the signature checked out, so only they learn why).
+func verifyUserSignature(ctx context.Context, db *sql.DB, user_id uint64, msg []byte, sigB64 string) error {
+	sig, err := base64.StdEncoding.DecodeString(sigB64)
+	if err != nil {
+		return errors.New("bad sig encoding")
+	}
+
+	var pubKey []byte
+	var disabled, expired bool
+	if err := db.QueryRowContext(ctx, `
+		SELECT k.signing_pubkey, u.disabled, COALESCE(u.expires_at <= now(), false)
+		FROM user_signing_key_table AS k
+		JOIN user_info_table AS u ON u.user_id = k.user_id
+		WHERE k.user_id = $1 AND k.revoked_at IS NULL AND u.deleted_at IS NULL`, user_id).
+		Scan(&pubKey, &disabled, &expired); err != nil {
+		return errors.New("no signing key for user")
+	}
+	if len(pubKey) != ed25519.PublicKeySize || !ed25519.Verify(pubKey, msg, sig) {
+		return errors.New("signature fail")
+	}
+	if disabled {
+		return errors.New("user suspended")
+	}
+	if expired {
+		return errors.New("account expired")
+	}
+	return nil
+}
+
+// httpHandleRotateSigningKey lets a user replace their signing key:
+//   - Phase‑1 challenge:  client POSTs  {user_id, new_pubkey}
+//     ↳ server returns   {nonce: "<hex>"}
+//   - Phase‑2 rotate:    client POSTs  {user_id, new_pubkey, sig, new_sig}
+//     ↳ server returns   {rotated: true}
+//
+// sig is made with the current key and new_sig with the new key, both over
+// nonce‖"/identity/rotate"‖0‖new_pubkey, so the request proves possession of both.
+func httpHandleRotateSigningKey(db *sql.DB, nonces NonceStore) http.HandlerFunc {
+	type request struct {
+		UserID    uint64 `json:"user_id"`
+		NewPubKey string `json:"new_pubkey"`
+		SigB64    string `json:"sig,omitempty"`
+		NewSigB64 string `json:"new_sig,omitempty"`
+	}
+	type respResult struct {
+		Rotated bool `json:"rotated"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		var req request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		new_key, err := parseSigningKey(req.NewPubKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// ---- Phase 1: challenge ----
+		if req.SigB64 == "" {
+			issueChallenge(w, r, nonces, req.UserID)
+			return
+		}
+
+		// ---- Phase 2: verify both signatures ----
+		nonce, err := nonces.Consume(r.Context(), req.UserID)
+		if err != nil {
+			http.Error(w, "no nonce", http.StatusForbidden)
+			return
+		}
+		msg := signedMessage(nonce, "/identity/rotate", new_key)
+		if err := verifyUserSignature(r.Context(), db, req.UserID, msg, req.SigB64); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		new_sig, err := base64.StdEncoding.DecodeString(req.NewSigB64)
+		if err != nil || !ed25519.Verify(new_key, msg, new_sig) {
+			http.Error(w, "new key signature fail", http.StatusForbidden)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		if err := setSigningKeyTx(ctx, tx, int64(req.UserID), new_key); err != nil {
+			http.Error(w, "rotate fail", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "rotate fail", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(respResult{Rotated: true})
+	}
+}
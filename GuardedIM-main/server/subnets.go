@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// DefaultRelayPrefixLen is the size of an automatically allocated relay subnet
+const DefaultRelayPrefixLen = 24
+
+// ErrSupernetFull means no block of the requested size is left in the supernet
+var ErrSupernetFull = errors.New("no free relay subnet left in the overlay supernet")
+
+// v4 arithmetic on addresses, only valid for IPv4
+func v4ToUint32(addr netip.Addr) uint32 {
+	b := addr.As4()
+	return binary.BigEndian.Uint32(b[:])
+}
+
+func uint32ToV4(n uint32) netip.Addr {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], n)
+	return netip.AddrFrom4(b)
+}
+
+// existingRelaySubnets reads every relay's subnet, tombstoned relays included so their block is not handed out again
+func existingRelaySubnets(ctx context.Context, q dbtx) ([]netip.Prefix, error) {
+	rows, err := q.QueryContext(ctx, `SELECT server_subnet FROM server_info_table`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subnets []netip.Prefix
+	for rows.Next() {
+		var subnet netip.Prefix
+		if err := rows.Scan(scanPrefix(&subnet)); err != nil {
+			return nil, err
+		}
+		subnets = append(subnets, subnet)
+	}
+	return subnets, rows.Err()
+}
+
+// allocateRelaySubnet returns the first /prefix_len block of supernet that overlaps none of existing
+func allocateRelaySubnet(existing []netip.Prefix, supernet netip.Prefix, prefix_len int) (netip.Prefix, error) {
+	if prefix_len < supernet.Bits() || prefix_len > 30 {
+		return netip.Prefix{}, fmt.Errorf("relay subnet /%d does not fit the supernet %s", prefix_len, supernet)
+	}
+
+	base := v4ToUint32(supernet.Addr())
+	step := uint32(1) << (32 - prefix_len)
+	count := uint64(1) << (prefix_len - supernet.Bits())
+	for i := uint64(0); i < count; i++ {
+		candidate := netip.PrefixFrom(uint32ToV4(base+uint32(i)*step), prefix_len)
+
+		free := true
+		for _, e := range existing {
+			if candidate.Overlaps(e) {
+				free = false
+				break
+			}
+		}
+		if free {
+			return candidate, nil
+		}
+	}
+	return netip.Prefix{}, ErrSupernetFull
+}
+
+// parseRelaySubnetRequest interprets the --subnet argument of addserver:
+// "" or "/N" ask for automatic allocation (of a /24 or a /N) and return the zero Prefix,
+// anything else is an explicit CIDR
+func parseRelaySubnetRequest(server_subnet string) (netip.Prefix, int, error) {
+	if len(server_subnet) == 0 {
+		return netip.Prefix{}, DefaultRelayPrefixLen, nil
+	}
+	if strings.HasPrefix(server_subnet, "/") {
+		n, err := strconv.Atoi(server_subnet[1:])
+		if err != nil {
+			return netip.Prefix{}, 0, fmt.Errorf("invalid subnet size %q", server_subnet)
+		}
+		return netip.Prefix{}, n, nil
+	}
+	prefix, err := netip.ParsePrefix(server_subnet)
+	if err != nil || !prefix.Addr().Is4() {
+		return netip.Prefix{}, 0, fmt.Errorf("invalid subnet %q", server_subnet)
+	}
+	if prefix != prefix.Masked() {
+		return netip.Prefix{}, 0, fmt.Errorf("subnet %q has host bits set, did you mean %s", server_subnet, prefix.Masked())
+	}
+	if prefix.Bits() > 30 {
+		return netip.Prefix{}, 0, fmt.Errorf("subnet %q is too small", server_subnet)
+	}
+	return prefix, prefix.Bits(), nil
+}
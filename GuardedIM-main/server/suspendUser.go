@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SuspendUser blocks a user, given by username or user_id, without removing anything:
+// relays drop its peer on their next reconciliation (see NotifyRelays) and its signed
+// requests are refused until ResumeUser.
+func SuspendUser(db *sql.DB, user string) (int64, error) {
+	return setUserDisabled(db, user, true, nil)
+}
+
+// ResumeUser lifts a suspension and, unless expires_at is nil, sets when the account stops
+// working in the same transaction, the zero Time meaning never. An expired account stays blocked.
+func ResumeUser(db *sql.DB, user string, expires_at *time.Time) (int64, error) {
+	return setUserDisabled(db, user, false, expires_at)
+}
+
+func setUserDisabled(db *sql.DB, user string, disabled bool, expires_at *time.Time) (int64, error) {
+	if len(user) == 0 {
+		return -2, errors.New("no user given")
+	}
+	var expiry any
+	if expires_at != nil && !expires_at.IsZero() {
+		if !expires_at.After(time.Now()) {
+			return -13, errors.New("expiry lies in the past")
+		}
+		expiry = *expires_at
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return -6, err
+	}
+	defer tx.Rollback()
+
+	user_id, err := resolveUser(ctx, tx, user)
+	if err != nil {
+		return -2, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE user_info_table SET disabled = $1 WHERE user_id = $2`,
+		disabled, user_id); err != nil {
+		return -6, fmt.Errorf("update user: %w", err)
+	}
+	if expires_at != nil {
+		if _, err := tx.ExecContext(ctx, `UPDATE user_info_table SET expires_at = $1 WHERE user_id = $2`,
+			expiry, user_id); err != nil {
+			return -6, fmt.Errorf("update user: %w", err)
+		}
+	}
+	if disabled {
+		// a challenge issued before the suspension must not be answerable afterwards
+		if _, err := tx.ExecContext(ctx, `DELETE FROM nonce_table WHERE user_id = $1;`, user_id); err != nil {
+			return -6, fmt.Errorf("delete nonce: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return -6, fmt.Errorf("commit user: %w", err)
+	}
+	return user_id, nil
+}
+
+// UserAccess reports whether a user is suspended and when its account expires (zero: never)
+func UserAccess(db *sql.DB, user_id int64) (bool, time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var disabled bool
+	var expires_at sql.NullTime
+	err := db.QueryRowContext(ctx, `SELECT disabled, expires_at FROM user_info_table WHERE user_id = $1`,
+		user_id).Scan(&disabled, &expires_at)
+	return disabled, expires_at.Time, err
+}
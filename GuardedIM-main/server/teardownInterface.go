@@ -0,0 +1,100 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"guardedim/overlay"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// this function reverses setupWG0Linux: it removes the overlay routes, the private address
+// and finally the ov.Interface link itself (which takes the IPv6 address along)
+// the forwarding sysctls go back to the values enableForwarding found
+// anything that is already gone is silently skipped
+func TeardownWG0Linux(ov overlay.Config, server_privip string) error {
+	// a failed restore must not keep the link around, it is reported at the end
+	restore_err := restoreForwarding(ov.Interface)
+	if restore_err != nil {
+		restore_err = fmt.Errorf("restore forwarding: %w", restore_err)
+	}
+
+	link, err := netlink.LinkByName(ov.Interface)
+	if err != nil {
+		var not_found netlink.LinkNotFoundError
+		if errors.As(err, &not_found) {
+			return restore_err
+		}
+		return err
+	}
+
+	routes := ov.RouteIPNets()
+	for i := range routes {
+		route := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       &routes[i],
+		}
+		if err := netlink.RouteDel(route); err != nil && !errors.Is(err, unix.ESRCH) {
+			return fmt.Errorf("delete route: %w", err)
+		}
+	}
+
+	if privip := net.ParseIP(server_privip); privip != nil {
+		ip_net := &net.IPNet{IP: privip, Mask: net.CIDRMask(128, 128)}
+		if v4 := privip.To4(); v4 != nil {
+			ip_net = &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}
+		}
+		if err := netlink.AddrDel(link, &netlink.Addr{IPNet: ip_net}); err != nil && !errors.Is(err, unix.EADDRNOTAVAIL) {
+			return fmt.Errorf("delete address: %w", err)
+		}
+	}
+
+	if err := netlink.LinkDel(link); err != nil && !errors.Is(err, unix.ENODEV) {
+		return fmt.Errorf("delete link: %w", err)
+	}
+	return restore_err
+}
+
+// this function lists what setupWG0Linux left behind on the host
+// an empty result means the TUN device, its address and its routes are all gone
+func WG0Residue(ov overlay.Config, server_privip string) ([]string, error) {
+	var residue []string
+
+	link, err := netlink.LinkByName(ov.Interface)
+	if err != nil {
+		var not_found netlink.LinkNotFoundError
+		if !errors.As(err, &not_found) {
+			return nil, err
+		}
+		link = nil
+	}
+	if link != nil {
+		residue = append(residue, "link "+ov.Interface)
+
+		routes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range routes {
+			if r.Dst != nil {
+				residue = append(residue, "route "+r.Dst.String())
+			}
+		}
+	}
+
+	// the address may only be removed together with the link, so look for it everywhere
+	if privip := net.ParseIP(server_privip); privip != nil {
+		addrs, err := netlink.AddrList(nil, netlink.FAMILY_ALL)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			if a.IP.Equal(privip) {
+				residue = append(residue, "address "+a.IPNet.String())
+			}
+		}
+	}
+	return residue, nil
+}
@@ -4,9 +4,12 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"guardedim/overlay"
 	"log"
 	"net"
-	"strings"
+	"net/netip"
+	"sync"
 	"time"
 
 	_ "golang.zx2c4.com/wireguard/device"
@@ -14,68 +17,85 @@ import (
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-func UpdateConnection(db *sql.DB) error {
+// PeerChanges reports what a reconciliation did to wg0, keyed by peer public key
+type PeerChanges struct {
+	Added   []string `json:"added"`
+	Changed []string `json:"changed"`
+	Removed []string `json:"removed"`
+}
+
+// serializes reconciliations triggered at startup and through the admin socket
+var reconcileMu sync.Mutex
+
+// this function reconciles the peers of the ov.Interface device with server_info_table and user_info_table
+// with a ULA prefix every peer also gets the IPv6 counterpart of its IPv4 AllowedIPs
+// it also reloads the ACL the packet filter enforces
+// return which peers were added, changed or removed
+func UpdateConnection(db *sql.DB, ov overlay.Config) (PeerChanges, error) {
+	reconcileMu.Lock()
+	defer reconcileMu.Unlock()
+
+	var changes PeerChanges
 
 	// preparations
 	type server_row struct {
-		PubIP  []byte
+		PubIP  netip.Addr
 		Port   int
-		PrivIP []byte
+		PrivIP netip.Addr
 		PubKey []byte
 		PSK    []byte
+		Subnet netip.Prefix
 	}
 	keepalive_interval := 25 * time.Second
 
 	// connect to the wireguard control
 	client, err := wgctrl.New()
 	if err != nil {
-		return err
+		return changes, err
 	}
 	defer client.Close()
 
-	// read existing wg0 device
-	wg_dev, err := client.Device("wg0")
+	// read existing wireguard device
+	wg_dev, err := client.Device(ov.Interface)
 	if err != nil {
-		return err
-	}
-
-	// keep the old configuration
-	new_conf := wgtypes.Config{
-		PrivateKey:   &wg_dev.PrivateKey,
-		ListenPort:   &wg_dev.ListenPort,
-		FirewallMark: &wg_dev.FirewallMark,
-		ReplacePeers: true,
+		return changes, err
 	}
 
 	// extract wg interface IP address
-	wg_iface, err := net.InterfaceByName("wg0")
+	wg_iface, err := net.InterfaceByName(ov.Interface)
 	if err != nil {
-		return err
+		return changes, err
 	}
 	addrs, err := wg_iface.Addrs()
 	if err != nil {
-		return err
+		return changes, err
 	}
-	var wg_privip string
+	// the IPv4 address identifies the relay, the ULA one is derived from it
+	var wg_privip netip.Addr
 	for _, a := range addrs {
 		if ipnet, ok := a.(*net.IPNet); ok {
 			if v4 := ipnet.IP.To4(); v4 != nil {
-				wg_privip = v4.String()
+				wg_privip, _ = netip.AddrFromSlice(v4)
 			}
 		}
 	}
-	if len(wg_privip) == 0 {
-		return errors.New("unable to get wireguard interface IP address")
+	if !wg_privip.IsValid() {
+		return changes, errors.New("unable to get wireguard interface IP address")
 	}
 
 	// database query
-	peer_server_SQL := `SELECT server_pubip, server_port, server_privip, server_pubkey, server_presharedkey
+	peer_server_SQL := `SELECT server_pubip, server_port, server_privip, server_pubkey, server_presharedkey, server_subnet
 						FROM server_info_table
-						WHERE server_privip <> $1;`
+						WHERE server_privip <> $1 AND deleted_at IS NULL;`
 
+	// users homed here, plus rows from before home_server_id whose address sits in our subnet;
+	// suspended and expired users lose their peer (expiry is noticed on the next reconciliation)
 	peer_user_SQL := `SELECT user_pubkey, latest_ip
 					  FROM user_info_table
-					  WHERE latest_ip LIKE $1;`
+					  WHERE deleted_at IS NULL AND NOT disabled AND (expires_at IS NULL OR expires_at > now())
+					    AND (home_server_id = $1 OR (home_server_id IS NULL AND latest_ip << $2));`
+
+	self_server_SQL := `SELECT server_id, server_subnet, deleted_at IS NOT NULL FROM server_info_table WHERE server_privip = $1;`
 
 	// start crafting server peers
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -83,14 +103,14 @@ func UpdateConnection(db *sql.DB) error {
 
 	rows, err := db.QueryContext(ctx, peer_server_SQL, wg_privip)
 	if err != nil {
-		return err
+		return changes, err
 	}
 	defer rows.Close()
 
 	new_peers := []wgtypes.PeerConfig{}
 	for rows.Next() {
 		var row server_row
-		if err := rows.Scan(&row.PubIP, &row.Port, &row.PrivIP, &row.PubKey, &row.PSK); err != nil {
+		if err := rows.Scan(scanAddr(&row.PubIP), &row.Port, scanAddr(&row.PrivIP), &row.PubKey, &row.PSK, scanPrefix(&row.Subnet)); err != nil {
 			log.Printf("scan server row failed: %v", err)
 			continue
 		}
@@ -106,18 +126,26 @@ func UpdateConnection(db *sql.DB) error {
 			continue
 		}
 
-		pubIP := net.IP(row.PubIP)
-		privIP := net.IP(row.PrivIP)
-		if pubIP == nil || privIP == nil {
-			log.Printf("skip server peer: invalid IP bytes")
+		if !row.PubIP.IsValid() || !row.PrivIP.IsValid() {
+			log.Printf("skip server peer: missing IP")
 			continue
 		}
 
+		// the peer relay's whole subnet (which holds its own address) goes through it,
+		// so traffic for users homed there is forwarded across the relay mesh
+		allowed := []netip.Prefix{hostPrefix(row.PrivIP)}
+		if row.Subnet.IsValid() {
+			allowed = []netip.Prefix{row.Subnet}
+		}
+		if ov.ULA.IsValid() {
+			allowed = append(allowed, overlay.EmbedPrefix6(ov.ULA, allowed[0]))
+		}
+
 		new_peers = append(new_peers, wgtypes.PeerConfig{
 			PublicKey:                   pubkey,
 			PresharedKey:                &psk,
-			Endpoint:                    &net.UDPAddr{IP: pubIP, Port: row.Port},
-			AllowedIPs:                  []net.IPNet{{IP: privIP, Mask: net.CIDRMask(32, 32)}},
+			Endpoint:                    net.UDPAddrFromAddrPort(netip.AddrPortFrom(row.PubIP, uint16(row.Port))),
+			AllowedIPs:                  overlay.IPNets(allowed...),
 			PersistentKeepaliveInterval: &keepalive_interval,
 			ReplaceAllowedIPs:           true,
 		})
@@ -127,18 +155,28 @@ func UpdateConnection(db *sql.DB) error {
 	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	wg_privip_prefix := wg_privip[:strings.LastIndex(wg_privip, ".")+1] + "%"
+	var self_server_id int64
+	var self_subnet netip.Prefix
+	var self_removed bool
+	err = db.QueryRowContext(ctx, self_server_SQL, wg_privip).Scan(&self_server_id, scanPrefix(&self_subnet), &self_removed)
+	if errors.Is(err, sql.ErrNoRows) || self_removed {
+		// this relay was removed (gdim removeserver), nobody may reach the overlay through it any more
+		return applyPeers(client, ov.Interface, wg_dev.Peers, nil)
+	}
+	if err != nil {
+		return changes, fmt.Errorf("look up this relay in server_info_table: %w", err)
+	}
 
-	rows, err = db.QueryContext(ctx, peer_user_SQL, wg_privip_prefix)
+	rows, err = db.QueryContext(ctx, peer_user_SQL, self_server_id, self_subnet)
 	if err != nil {
-		return err
+		return changes, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var pubKeyBytes []byte
-		var userIP string
-		if err := rows.Scan(&pubKeyBytes, &userIP); err != nil {
+		var userIP netip.Addr
+		if err := rows.Scan(&pubKeyBytes, scanAddr(&userIP)); err != nil {
 			log.Printf("scan user row failed: %v", err)
 			continue
 		}
@@ -148,20 +186,105 @@ func UpdateConnection(db *sql.DB) error {
 			continue
 		}
 		new_peers = append(new_peers, wgtypes.PeerConfig{
-			PublicKey: pubkey,
-			AllowedIPs: []net.IPNet{{
-				IP:   net.ParseIP(userIP),
-				Mask: net.CIDRMask(32, 32),
-			}},
+			PublicKey:                   pubkey,
+			AllowedIPs:                  overlay.IPNets(ov.DualStack(userIP)...),
 			ReplaceAllowedIPs:           true,
 			PersistentKeepaliveInterval: &keepalive_interval,
 		})
 	}
 
-	new_conf.Peers = new_peers
-	if err := client.ConfigureDevice("wg0", new_conf); err != nil {
-		return err
+	if err := loadACL(ctx, db, ov, wg_privip); err != nil {
+		return changes, fmt.Errorf("load acl: %w", err)
 	}
-	return nil
+	return applyPeers(client, ov.Interface, wg_dev.Peers, new_peers)
+}
+
+// this function applies only the difference between the live and the wanted peers,
+// so unchanged peers keep their sessions
+// return the report of what changed
+func applyPeers(client *wgctrl.Client, iface string, current []wgtypes.Peer, wanted []wgtypes.PeerConfig) (PeerChanges, error) {
+	// only touch peers, leaving key, port and fwmark (and thus the UDP bind) alone
+	new_conf := wgtypes.Config{
+		ReplacePeers: false,
+	}
+	var changes PeerChanges
+	new_conf.Peers, changes = diffPeers(current, wanted)
+	if len(new_conf.Peers) == 0 {
+		return changes, nil
+	}
+	if err := client.ConfigureDevice(iface, new_conf); err != nil {
+		return changes, err
+	}
+	return changes, nil
+}
 
+// this function compares the live peers against the wanted configuration
+// return the peer configs to apply (new, changed and Remove entries) along with the report
+func diffPeers(current []wgtypes.Peer, wanted []wgtypes.PeerConfig) ([]wgtypes.PeerConfig, PeerChanges) {
+	changes := PeerChanges{Added: []string{}, Changed: []string{}, Removed: []string{}}
+	var delta []wgtypes.PeerConfig
+
+	current_by_key := make(map[wgtypes.Key]wgtypes.Peer, len(current))
+	for _, p := range current {
+		current_by_key[p.PublicKey] = p
+	}
+	wanted_keys := make(map[wgtypes.Key]bool, len(wanted))
+	for _, w := range wanted {
+		wanted_keys[w.PublicKey] = true
+		cur, ok := current_by_key[w.PublicKey]
+		if !ok {
+			changes.Added = append(changes.Added, w.PublicKey.String())
+			delta = append(delta, w)
+		} else if peerChanged(cur, w) {
+			changes.Changed = append(changes.Changed, w.PublicKey.String())
+			// a nil PresharedKey means "leave as is", clear a stale one explicitly
+			if w.PresharedKey == nil {
+				w.PresharedKey = &wgtypes.Key{}
+			}
+			w.UpdateOnly = true
+			delta = append(delta, w)
+		}
+	}
+	for _, p := range current {
+		if !wanted_keys[p.PublicKey] {
+			changes.Removed = append(changes.Removed, p.PublicKey.String())
+			delta = append(delta, wgtypes.PeerConfig{PublicKey: p.PublicKey, Remove: true})
+		}
+	}
+	return delta, changes
+}
+
+// this function tells whether applying the wanted config would alter the live peer
+func peerChanged(cur wgtypes.Peer, want wgtypes.PeerConfig) bool {
+	want_psk := wgtypes.Key{}
+	if want.PresharedKey != nil {
+		want_psk = *want.PresharedKey
+	}
+	if cur.PresharedKey != want_psk {
+		return true
+	}
+
+	if want.Endpoint != nil {
+		if cur.Endpoint == nil || !cur.Endpoint.IP.Equal(want.Endpoint.IP) || cur.Endpoint.Port != want.Endpoint.Port {
+			return true
+		}
+	}
+
+	if want.PersistentKeepaliveInterval != nil && cur.PersistentKeepaliveInterval != *want.PersistentKeepaliveInterval {
+		return true
+	}
+
+	if len(cur.AllowedIPs) != len(want.AllowedIPs) {
+		return true
+	}
+	cur_ips := make(map[string]bool, len(cur.AllowedIPs))
+	for _, a := range cur.AllowedIPs {
+		cur_ips[a.String()] = true
+	}
+	for _, a := range want.AllowedIPs {
+		if !cur_ips[a.String()] {
+			return true
+		}
+	}
+	return false
 }